@@ -1,11 +1,74 @@
 package stash
 
 import (
+	"bytes"
 	"io"
+	"os"
 
 	"github.com/pierrec/lz4"
 )
 
+// Codec compresses blobs on their way to disk and decompresses them on their way back. Closing a reader or writer returned by a Codec must close the one it wraps.
+type Codec interface {
+	NewReader(r io.ReadCloser) io.ReadCloser
+	NewWriter(w io.WriteCloser) io.WriteCloser
+}
+
+// newCodecReader wraps r in a reader of codec. Should the codec fail to return one, or panic, r is closed rather than leaked.
+func newCodecReader(codec Codec, r io.ReadCloser) (cr io.ReadCloser, err error) {
+	defer func() {
+		if cr == nil {
+			r.Close()
+		}
+	}()
+
+	cr = codec.NewReader(r)
+	if cr == nil {
+		return nil, errNoReader
+	}
+	return cr, nil
+}
+
+// LZ4 is the Codec used by WithDeflate.
+var LZ4 Codec = lz4Codec{}
+
+// maxCompressionLevel is the highest level WithCompressionLevel accepts: the number of earlier matches lz4 tries at most, as it never looks back further than 64KB.
+const maxCompressionLevel = 1 << 16
+
+type lz4Codec struct {
+	level int
+}
+
+// lz4Magic is the magic number every LZ4 frame starts with, little-endian.
+var lz4Magic = []byte{0x04, 0x22, 0x4d, 0x18}
+
+// isCompressed reports whether the file at path, adopted without a record of how it was stored, is compressed. LZ4 frames are told apart from raw blobs by their magic number, so that a directory mixing both, e.g. from runs with and without WithDeflate, reads back intact; a raw blob that happens to start with it is mistaken for a compressed one. With any other codec, files are taken to be compressed.
+func (c *Cache) isCompressed(path string) bool {
+	if _, ok := c.codec.(lz4Codec); c.codec != nil && !ok {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return c.codec != nil
+	}
+	defer f.Close()
+	b := make([]byte, len(lz4Magic))
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false // Too short to be a frame.
+	}
+	return bytes.Equal(b, lz4Magic)
+}
+
+func (lz4Codec) NewReader(r io.ReadCloser) io.ReadCloser {
+	return NewDeflateReader(r)
+}
+
+func (l lz4Codec) NewWriter(w io.WriteCloser) io.WriteCloser {
+	zw := lz4.NewWriter(w)
+	zw.Header.CompressionLevel = l.level
+	return zw
+}
+
 type DeflateReader struct {
 	r   io.Reader
 	src io.ReadCloser
@@ -1,15 +1,37 @@
 package stash
 
-import "errors"
+import (
+	"errors"
+	"sort"
+	"strings"
+)
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrCorrupt       = errors.New("checksum mismatch")
+	ErrClosed        = errors.New("cache closed")
+	ErrBadKey        = errors.New("key does not map to a file in storage directory")
+	ErrBadRange      = errors.New("range must not start before the blob")
+	ErrKeyCollision  = errors.New("key maps to the same file as another key")
+
+	ErrNoRandomAccess = errors.New("compressed blobs do not support random access")
 
 	ErrBadDir  = errors.New("invalid directory")
 	ErrBadSize = errors.New("storage size must be greater then zero")
 	ErrBadCap  = errors.New("file number must be greater then zero")
 
+	ErrBadShards     = errors.New("shard number must be greater then zero")
+	ErrTooManyShards = errors.New("shard number must not exceed storage size or file number")
+
 	ErrTooLarge = errors.New("file size must be less or equal storage size")
+	ErrNoSpace  = errors.New("not enough free disk space")
+
+	ErrBadAccounting = errors.New("total size or number of files went below zero")
+
+	errLoadPanicked = errors.New("loader panicked")
+	errStale        = errors.New("entry changed while being read")
+	errNoReader     = errors.New("codec returned no reader")
 )
 
 // FileError records the storage directory name and key of the that failed to cached.
@@ -22,3 +44,58 @@ type FileError struct {
 func (e *FileError) Error() string {
 	return "stash: " + e.Dir + " " + e.Key + ": " + e.Err.Error()
 }
+
+// Unwrap returns the underlying error, for errors.Is and errors.As.
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// badDirError reports why a storage directory cannot be used. It matches ErrBadDir.
+type badDirError struct {
+	err error
+}
+
+func (e *badDirError) Error() string {
+	return ErrBadDir.Error() + ": " + e.err.Error()
+}
+
+func (e *badDirError) Is(target error) bool {
+	return target == ErrBadDir
+}
+
+func (e *badDirError) Unwrap() error {
+	return e.err
+}
+
+// BatchError records the keys of a batch that failed to cached, along with their errors.
+type BatchError struct {
+	Errs map[string]error
+}
+
+func (e *BatchError) Error() string {
+	return "stash: batch failed for " + joinErrs(e.Errs)
+}
+
+// EvictError records the keys of the entries that had to be skipped while making room, as their files could not be removed, along with their errors.
+type EvictError struct {
+	Errs map[string]error
+}
+
+func (e *EvictError) Error() string {
+	return "stash: could not evict " + joinErrs(e.Errs)
+}
+
+// joinErrs formats errors by key, sorted by key.
+func joinErrs(errs map[string]error) string {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = key + ": " + errs[key].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
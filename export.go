@@ -0,0 +1,112 @@
+package stash
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Export writes the blobs in the cache to w as a tar archive, least recently used first. Each blob is stored as it is on disk, compressed if the cache compresses blobs, under its escaped key. Ephemeral and expired blobs are left out. The read lock is held throughout.
+func (c *Cache) Export(w io.Writer) error {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	tw := tar.NewWriter(w)
+	for item := c.list.Back(); item != nil; item = item.Prev() {
+		m := item.Value.(*Meta)
+		if isEphemeral(filepath.Base(m.Path)) || m.expired() {
+			continue
+		}
+		if err := exportFile(tw, m); err != nil {
+			return &FileError{c.dir, m.Key, err}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return &FileError{c.dir, "", err}
+	}
+	return nil
+}
+
+func exportFile(tw *tar.Writer, m *Meta) error {
+	f, err := os.Open(m.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     escape(m.Key),
+		Size:     m.Size,
+		Mode:     0666,
+		ModTime:  m.LastAccess,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, m.Size)
+	return err
+}
+
+// Import adds the blobs in a tar archive written by Export to the cache, evicting entries as needed, so that the last blob in the archive ends up the most recently used. The blobs are taken as they are: compressed and raw ones are told apart by the magic number of LZ4, but with any other codec, the cache must compress blobs like the exporting one did. Import stops at the first blob it fails to add.
+func (c *Cache) Import(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &FileError{c.dir, "", err}
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		key, err := unescape(h.Name)
+		if err != nil {
+			return &FileError{c.dir, h.Name, ErrBadKey}
+		}
+		if err := c.importFile(key, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// importFile adds the contents of r as they are, without compressing them, as the file of the given key.
+func (c *Cache) importFile(key string, r io.Reader) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if err := c.checkWriteOnce(key); err != nil {
+		return err
+	}
+	name, err := c.filename(key)
+	if err != nil {
+		return err
+	}
+	if c.useNames() {
+		if err := appendName(c.dir, name, key, c.filePerm()); err != nil {
+			return err
+		}
+	}
+	path, n, _, err := c.writeFile(name, r, nil, c.maxEntrySize())
+	if err != nil {
+		return err
+	}
+	if err := c.validate(key, path, n, n); err != nil { // Archives hold blobs as stored, so their length before compression is unknown.
+		return err
+	}
+	c.addMeta(key, path, n, n).Compressed = c.isCompressed(path) // Blobs below WithDeflateMinSize are stored raw.
+	c.countPut(n)
+	return nil
+}
@@ -1,35 +1,302 @@
 package stash
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 )
 
-// writeFile writes a new file to the cache storage.
-func writeFile(dir, key string, r io.Reader, useDeflate bool) (path string, size int64, err error) {
+// ephemeralPrefix tags the filenames of entries that must not outlive the process. The escaped form of a key never contains it.
+const ephemeralPrefix = "#"
+
+// reservedPrefix starts the names of files the cache keeps for its own bookkeeping. Neither escaped keys nor hashes start with it, so these cannot collide with blobs.
+const reservedPrefix = "@"
+
+const (
+	namesFile = reservedPrefix + "names" // Keys of blobs stored under hashed filenames
+	indexFile = reservedPrefix + "index" // Entries of the cache as of the last Close
+
+	namespacePrefix = reservedPrefix + "ns."  // Prefix of the directories of namespaces
+	tempPrefix      = reservedPrefix + "tmp." // Prefix of files being written, until they are renamed into place
+	headerPrefix    = reservedPrefix + "hdr." // Prefix of the files holding the headers of blobs
+)
+
+// writeFile writes a new file to the storage directory at the relative path key, creating any directories on the way, and returns its size on disk along with the number of bytes read from r. Writing fails with ErrTooLarge once more than limit bytes reach the disk. The file is written under a temporary name and renamed into place once complete, so an existing file at path is only replaced on success, and no partial file is left behind on failure.
+func (c *Cache) writeFile(key string, r io.Reader, codec Codec, limit int64) (path string, size, length int64, err error) {
+	dir := c.dir
 	path = filepath.Join(dir, key)
+	tmp := c.tempPath(path)
 
-	f, err := os.Create(path)
+	if err := os.MkdirAll(filepath.Dir(path), c.dirPerm()); err != nil {
+		return "", 0, 0, &FileError{dir, key, err}
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.filePerm())
 	if err != nil {
-		return "", 0, &FileError{dir, key, err}
+		return "", 0, 0, &FileError{dir, key, err}
 	}
-	defer f.Close()
 
-	if useDeflate {
-		w := NewDeflateWriter(f)
-		size, err = io.Copy(w, r)
-		w.Close()
+	lw := &limitedWriter{f, limit}
+	if codec != nil {
+		w := codec.NewWriter(nopCloser{lw})
+		length, err = io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
 	} else {
-		size, err = io.Copy(f, r)
+		length, err = io.Copy(lw, r)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = moveFile(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", 0, 0, &FileError{dir, key, err}
+	}
+
+	return path, limit - lw.n, length, nil
+}
+
+// tempPath returns the path of the temporary file a blob bound for path is written to: next to it, or in the directory set by WithTempDir.
+func (c *Cache) tempPath(path string) string {
+	if c.tempDir == "" {
+		return filepath.Join(filepath.Dir(path), tempPrefix+filepath.Base(path))
+	}
+	return filepath.Join(c.tempDir, tempPrefix+hashName(path))
+}
+
+// moveFile renames src to dst. Where that fails, as across filesystems, src is copied next to dst under a temporary name and renamed into place, so that dst only ever appears complete, and then removed.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	tmp := filepath.Join(filepath.Dir(dst), tempPrefix+filepath.Base(dst))
+	if linkOrCopy(src, tmp) != nil || os.Rename(tmp, dst) != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+// filePerm returns the permissions of the files the cache creates.
+func (c *Cache) filePerm() os.FileMode {
+	if c.fileMode != 0 {
+		return c.fileMode
+	}
+	return 0666
+}
+
+// dirPerm returns the permissions of the directories the cache creates.
+func (c *Cache) dirPerm() os.FileMode {
+	if c.dirMode != 0 {
+		return c.dirMode
+	}
+	return 0777
+}
+
+// limitedWriter writes to w until n bytes have been written and fails with ErrTooLarge past that.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, ErrTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// contextReader reads from r until ctx is done and fails with the error of ctx from then on.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type contextReadCloser struct {
+	contextReader
+	io.Closer
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type readAtCloser struct {
+	io.ReaderAt
+}
+
+func (readAtCloser) Close() error {
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// linkOrCopy makes the file at src available at dst, by hard link where possible and by copy otherwise.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	s, err := r.Stat()
+	if err != nil {
+		return err
+	}
+
+	w, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.Mode().Perm())
+	if err != nil {
+		return err
 	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, s.ModTime(), s.ModTime())
+}
+
+// swapDir replaces dir with tmp, removing the old contents of dir. It takes two renames, moving dir aside to tmp+".old" and tmp into its place, so it is not atomic: should the process crash in between, dir is missing until recoverSwap puts tmp in its place.
+func swapDir(dir, tmp string) error {
+	old := tmp + ".old"
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.Rename(old, dir)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// compactPrefix returns the prefix of the names of the directories CompactLayout builds next to dir.
+func compactPrefix(dir string) string {
+	return filepath.Base(dir) + ".compact-"
+}
 
+// recoverSwap cleans up after a CompactLayout of dir interrupted by a crash, going by the directories it left next to dir. If the crash came between the renames of swapDir, dir is missing while the new directory is complete, and the new directory is moved into place. Otherwise dir is intact: a new directory that never got swapped in is removed, after the namespace directories moved into it are handed back, and so is an old directory left over from a swap.
+func recoverSwap(dir string) error {
+	parent := filepath.Dir(dir)
+	f, err := os.Open(parent)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
 	if err != nil {
-		return "", 0, &FileError{dir, key, err}
+		return err
 	}
 
-	return
+	var olds []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, compactPrefix(dir)) {
+			continue
+		}
+		tmp := filepath.Join(parent, name)
+		if strings.HasSuffix(name, ".old") {
+			olds = append(olds, tmp)
+			continue
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if _, err := os.Stat(tmp + ".old"); err == nil {
+				if err := os.Rename(tmp, dir); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := moveReserved(tmp, dir); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(tmp); err != nil {
+			return err
+		}
+	}
+	for _, old := range olds {
+		if err := os.RemoveAll(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksumFile returns the CRC-32 of the file at path.
+func checksumFile(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, &FileError{path, filepath.Base(path), err}
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, &FileError{path, filepath.Base(path), err}
+	}
+	return h.Sum32(), nil
+}
+
+// moveReserved moves the namespace directories of dir over to tmp.
+func moveReserved(dir, tmp string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, namespacePrefix) {
+			if err := os.Rename(filepath.Join(dir, name), filepath.Join(tmp, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func filesize(path string) (int64, error) {
@@ -43,3 +310,242 @@ func filesize(path string) (int64, error) {
 func escape(v string) string {
 	return url.QueryEscape(v)
 }
+
+func unescape(v string) (string, error) {
+	return url.QueryUnescape(v)
+}
+
+func hashName(key string) string {
+	return contentKey([]byte(key))
+}
+
+// contentKey returns the hex-encoded SHA-256 hash of b.
+func contentKey(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// readNames returns the keys recorded in the names file of dir by filename.
+func readNames(dir string) (map[string]string, error) {
+	names := map[string]string{}
+	b, err := ioutil.ReadFile(filepath.Join(dir, namesFile))
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, &FileError{dir, namesFile, err}
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.SplitN(line, " ", 2)
+		if len(f) != 2 {
+			continue
+		}
+		if key, err := unescape(f[1]); err == nil {
+			names[f[0]] = key
+		}
+	}
+	return names, nil
+}
+
+// appendName records the key of the blob stored under name in the names file of dir.
+func appendName(dir, name, key string, perm os.FileMode) error {
+	f, err := os.OpenFile(filepath.Join(dir, namesFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+	if err != nil {
+		return &FileError{dir, namesFile, err}
+	}
+	_, err = f.WriteString(name + " " + escape(key) + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return &FileError{dir, namesFile, err}
+	}
+	return nil
+}
+
+// writeNames replaces the names file of dir with the given records, dropping any stale ones.
+func writeNames(dir string, names map[string]string, perm os.FileMode) error {
+	lines := make([]string, 0, len(names))
+	for name, key := range names {
+		lines = append(lines, name+" "+escape(key)+"\n")
+	}
+	sort.Strings(lines)
+	if err := ioutil.WriteFile(filepath.Join(dir, namesFile), []byte(strings.Join(lines, "")), perm); err != nil {
+		return &FileError{dir, namesFile, err}
+	}
+	return nil
+}
+
+// headerPath returns the path to the file holding the header of the blob at path.
+func headerPath(path string) string {
+	return filepath.Join(filepath.Dir(path), headerPrefix+filepath.Base(path))
+}
+
+// readHeader returns the header of the blob at path, or nil if it has none.
+func readHeader(path string) (map[string]string, error) {
+	hpath := headerPath(path)
+	b, err := ioutil.ReadFile(hpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &FileError{filepath.Dir(hpath), filepath.Base(hpath), err}
+	}
+	var h map[string]string
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, &FileError{filepath.Dir(hpath), filepath.Base(hpath), err}
+	}
+	return h, nil
+}
+
+// writeHeader saves the header of the blob at path next to it.
+func writeHeader(path string, h map[string]string, perm os.FileMode) error {
+	hpath := headerPath(path)
+	b, err := json.Marshal(h)
+	if err == nil {
+		err = ioutil.WriteFile(hpath, b, perm)
+	}
+	if err != nil {
+		os.Remove(hpath)
+		return &FileError{filepath.Dir(hpath), filepath.Base(hpath), err}
+	}
+	return nil
+}
+
+// isNoSpace reports whether err is caused by the disk running out of space.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// safeName reports whether name is a relative path that stays inside a directory when joined to it, without clashing with the files of the cache's own bookkeeping.
+func safeName(name string) bool {
+	if filepath.IsAbs(name) {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == "" || elem == "." || elem == ".." || isReserved(elem) || strings.Contains(elem, `\`) {
+			return false
+		}
+	}
+	return true
+}
+
+// ephemeralName returns the name of the file of an ephemeral blob that would otherwise be stored at name.
+func ephemeralName(name string) string {
+	return filepath.Join(filepath.Dir(name), ephemeralPrefix+filepath.Base(name))
+}
+
+// dirFile is a file found by listFiles.
+type dirFile struct {
+	name string // Path relative to the listed directory
+	os.FileInfo
+}
+
+// listFiles returns the files in dir, other than reserved ones. With nested set, it descends into subdirectories other than reserved ones; otherwise subdirectories are left out. The files of each directory are stat'ed by up to workers goroutines at a time, which pays off on network filesystems where each stat is a round trip.
+func listFiles(dir string, nested bool, workers int) ([]dirFile, error) {
+	var files []dirFile
+	dirs := []string{"."}
+	for len(dirs) > 0 {
+		var names []string
+		for _, d := range dirs {
+			f, err := os.Open(filepath.Join(dir, d))
+			if err != nil {
+				return nil, err
+			}
+			dnames, err := f.Readdirnames(-1)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range dnames {
+				if !isReserved(name) {
+					names = append(names, filepath.Join(d, name))
+				}
+			}
+		}
+
+		infos, err := statFiles(dir, names, workers)
+		if err != nil {
+			return nil, err
+		}
+		dirs = dirs[:0]
+		for i, info := range infos {
+			switch {
+			case info == nil:
+				// Removed since listed
+			case info.IsDir():
+				if nested {
+					dirs = append(dirs, names[i])
+				}
+			default:
+				files = append(files, dirFile{names[i], info})
+			}
+		}
+	}
+	return files, nil
+}
+
+// statFiles stats the files in dir by name, using up to workers goroutines. Files that no longer exist have no info.
+func statFiles(dir string, names []string, workers int) ([]os.FileInfo, error) {
+	infos := make([]os.FileInfo, len(names))
+	errs := make([]error, len(names))
+
+	parallel(len(names), workers, func(i int) {
+		infos[i], errs[i] = os.Lstat(filepath.Join(dir, names[i]))
+	})
+
+	for i, err := range errs {
+		if os.IsNotExist(err) {
+			infos[i] = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// fileProbe holds what adopting a file takes beyond its stat: its header, and whether it is compressed.
+type fileProbe struct {
+	header     map[string]string
+	compressed bool
+	err        error
+}
+
+// probeFiles reads the headers of the files at paths, and whether they are compressed, using up to warmupWorkers goroutines.
+func (c *Cache) probeFiles(paths []string) []fileProbe {
+	probes := make([]fileProbe, len(paths))
+	parallel(len(paths), c.warmupWorkers, func(i int) {
+		p := &probes[i]
+		p.header, p.err = readHeader(paths[i])
+		p.compressed = c.isCompressed(paths[i])
+	})
+	return probes
+}
+
+// parallel calls f for every index below n, using up to workers goroutines.
+func parallel(n, workers int, f func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func isReserved(name string) bool {
+	return strings.HasPrefix(name, reservedPrefix)
+}
+
+func isEphemeral(name string) bool {
+	return strings.HasPrefix(name, ephemeralPrefix)
+}
@@ -0,0 +1,43 @@
+package stash
+
+import "sync"
+
+// call is an in-flight load.
+type call struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+// flight deduplicates concurrent loads of the same key.
+type flight struct {
+	mu sync.Mutex
+	m  map[string]*call
+}
+
+// do calls fn and returns its result. Callers arriving with the same key while fn is running wait for it and share its result instead of calling fn themselves. Nothing is remembered once fn returns, whether it succeeded or not.
+func (f *flight) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	if f.m == nil {
+		f.m = make(map[string]*call)
+	}
+	if c, ok := f.m[key]; ok {
+		f.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &call{err: errLoadPanicked}
+	c.wg.Add(1)
+	f.m[key] = c
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.m, key)
+		f.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	c.val, c.err = fn()
+	return c.val, c.err
+}
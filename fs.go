@@ -0,0 +1,139 @@
+package stash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// FS returns a read-only view of the cache as a filesystem, e.g. to serve blobs with http.FileServer through http.FS. Opening a name opens the blob of the key of that name, decompressed, and promotes it as Get does. Only keys that are valid names as per fs.ValidPath can be opened. The root directory lists the blobs whose keys contain no slash. Stat reports the size of a blob as read, as in Meta.Length, so that it matches the contents served. Files can seek, as http.FileServer requires; as compressed streams cannot, compressed blobs are read into memory in full when opened.
+func (c *Cache) FS() fs.FS {
+	return cacheFS{c}
+}
+
+type cacheFS struct {
+	c *Cache
+}
+
+func (f cacheFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return f.root()
+	}
+
+	r, m, err := f.c.GetReader(name, true)
+	if errors.Is(err, ErrNotFound) {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		rs = bytes.NewReader(b)
+		r = ioutil.NopCloser(nil)
+		m.Length = int64(len(b)) // Unknown for compressed files adopted by Warmup.
+	}
+	return &cacheFile{rs, r, fileInfo{m}}, nil
+}
+
+// root returns the root directory, listing the blobs whose keys are valid names without a slash, in eviction order.
+func (f cacheFS) root() (fs.File, error) {
+	f.c.l.RLock()
+	defer f.c.l.RUnlock()
+
+	if f.c.closed {
+		return nil, &fs.PathError{Op: "open", Path: ".", Err: ErrClosed}
+	}
+
+	d := &cacheDir{}
+	for item := f.c.list.Front(); item != nil; item = item.Next() {
+		m := item.Value.(*Meta)
+		if fs.ValidPath(m.Key) && m.Key != "." && !strings.Contains(m.Key, "/") {
+			d.entries = append(d.entries, fileInfo{copyMeta(m)})
+		}
+	}
+	return d, nil
+}
+
+// cacheFile is a blob opened through FS.
+type cacheFile struct {
+	io.ReadSeeker
+	io.Closer
+	info fileInfo
+}
+
+func (f *cacheFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// cacheDir is the root directory of FS.
+type cacheDir struct {
+	entries []fileInfo
+	off     int
+}
+
+func (d *cacheDir) Stat() (fs.FileInfo, error) {
+	return dirInfo{}, nil
+}
+
+func (d *cacheDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+func (d *cacheDir) Close() error {
+	return nil
+}
+
+func (d *cacheDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.off += len(rest)
+
+	entries := make([]fs.DirEntry, len(rest))
+	for i, e := range rest {
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// fileInfo describes a blob as both fs.FileInfo and fs.DirEntry. The cache does not know when blobs were written, so their modification time is zero.
+type fileInfo struct {
+	m Meta
+}
+
+func (i fileInfo) Name() string               { return path.Base(i.m.Key) }
+func (i fileInfo) Size() int64                { return i.m.Length }
+func (i fileInfo) Mode() fs.FileMode          { return 0444 }
+func (i fileInfo) ModTime() time.Time         { return time.Time{} }
+func (i fileInfo) IsDir() bool                { return false }
+func (i fileInfo) Sys() interface{}           { return i.m }
+func (i fileInfo) Type() fs.FileMode          { return 0 }
+func (i fileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// dirInfo describes the root directory of FS.
+type dirInfo struct{}
+
+func (dirInfo) Name() string       { return "." }
+func (dirInfo) Size() int64        { return 0 }
+func (dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (dirInfo) ModTime() time.Time { return time.Time{} }
+func (dirInfo) IsDir() bool        { return true }
+func (dirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,116 @@
+package stash
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// indexEntry is the persisted form of an entry of the cache.
+type indexEntry struct {
+	Key        string
+	Name       string
+	Size       int64
+	Length     int64             `json:",omitempty"`
+	Checksum   uint32            `json:",omitempty"`
+	Compressed *bool             `json:",omitempty"` // nil if saved before it was
+	Expires    time.Time         `json:",omitempty"`
+	Header     map[string]string `json:",omitempty"`
+	LastAccess time.Time         `json:",omitempty"`
+}
+
+// writeIndex saves the entries of the cache to the index file, in eviction order. Ephemeral entries are left out.
+func (c *Cache) writeIndex() error {
+	entries := make([]indexEntry, 0, c.list.Len())
+	for item := c.list.Front(); item != nil; item = item.Next() {
+		m := item.Value.(*Meta)
+		if isEphemeral(filepath.Base(m.Path)) {
+			continue
+		}
+		name, err := filepath.Rel(c.dir, m.Path)
+		if err != nil {
+			return &FileError{c.dir, m.Key, err}
+		}
+		compressed := m.Compressed
+		entries = append(entries, indexEntry{m.Key, name, m.Size, m.Length, m.Checksum, &compressed, m.Expires, m.Header, m.LastAccess})
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return &FileError{c.dir, indexFile, err}
+	}
+	tmp := filepath.Join(c.dir, indexFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, c.filePerm()); err != nil {
+		return &FileError{c.dir, indexFile, err}
+	}
+	if err := os.Rename(tmp, filepath.Join(c.dir, indexFile)); err != nil {
+		os.Remove(tmp)
+		return &FileError{c.dir, indexFile, err}
+	}
+	return nil
+}
+
+// readIndex restores the entries of the cache from the index file, and reports whether there was a usable one. The index file is removed once read: it only describes the cache as of the last Close, and must not outlive later changes. Entries are not taken on trust: those whose name leads outside the storage directory, whose key or file is already taken, or whose file is gone are left out, and the rest are evicted down to the current limits.
+func (c *Cache) readIndex() (bool, error) {
+	path := filepath.Join(c.dir, indexFile)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, &FileError{c.dir, indexFile, err}
+	}
+	if err := os.Remove(path); err != nil {
+		return false, &FileError{c.dir, indexFile, err}
+	}
+
+	var entries []indexEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return false, nil // A broken index is as good as none.
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !safeName(e.Name) {
+			c.logf("stash: skipped %q in index: bad name %q", e.Key, e.Name)
+			continue
+		}
+		path := filepath.Join(c.dir, e.Name)
+		if _, ok := c.m[escape(e.Key)]; ok {
+			c.logf("stash: skipped %q in index: duplicate key", e.Key)
+			continue
+		}
+		if _, ok := c.files[path]; ok {
+			c.logf("stash: skipped %q in index: file %s taken", e.Key, e.Name)
+			continue
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			c.logf("stash: skipped %q in index: file is gone", e.Key)
+			continue
+		} else if err != nil {
+			return false, &FileError{c.dir, e.Key, err}
+		}
+		if e.Length == 0 {
+			e.Length = e.Size // Saved before lengths were, or empty.
+		}
+		m := c.addMeta(e.Key, path, e.Size, e.Length)
+		m.Checksum = e.Checksum
+		if e.Compressed != nil {
+			m.Compressed = *e.Compressed
+		} else {
+			m.Compressed = c.isCompressed(m.Path)
+		}
+		m.Expires = e.Expires
+		m.Header = e.Header
+		if !e.LastAccess.IsZero() {
+			m.LastAccess = e.LastAccess
+		}
+	}
+
+	// The limits may have shrunk since the index was saved.
+	if _, err := c.evictDown(c.size, c.cap, 0, 0); err != nil {
+		return true, err
+	}
+	return true, nil
+}
@@ -0,0 +1,94 @@
+package stash
+
+import (
+	"container/list"
+	"os"
+	"time"
+)
+
+// StartJanitor starts a goroutine that evicts blobs older than maxAge every interval, whether or not they are used. The age of a blob is the time since its file was last written. Calling StartJanitor again replaces the running janitor, and a non-positive interval just stops it. Close stops the janitor too.
+func (c *Cache) StartJanitor(interval, maxAge time.Duration) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	c.stopJanitor()
+	if interval <= 0 {
+		return nil
+	}
+
+	stop := make(chan struct{})
+	c.janitor = stop
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				c.sweep(maxAge)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// stopJanitor stops the janitor, if running. The caller must hold the write lock.
+func (c *Cache) stopJanitor() {
+	if c.janitor != nil {
+		close(c.janitor)
+		c.janitor = nil
+	}
+}
+
+// sweep evicts the blobs older than maxAge. The files are stat'ed without the lock, so that sweeping a large or remote directory does not hold up other operations; those found old are stat'ed again under the lock before being evicted, in case they have been written since.
+func (c *Cache) sweep(maxAge time.Duration) {
+	defer c.notifyEvicted()
+
+	type entry struct {
+		item *list.Element
+		path string
+	}
+	c.l.RLock()
+	if c.closed {
+		c.l.RUnlock()
+		return // Close raced with the tick.
+	}
+	entries := make([]entry, 0, c.list.Len())
+	for item := c.list.Back(); item != nil; item = item.Prev() {
+		entries = append(entries, entry{item, item.Value.(*Meta).Path})
+	}
+	c.l.RUnlock()
+
+	deadline := time.Now().Add(-maxAge)
+	old := make([]bool, len(entries))
+	parallel(len(entries), c.warmupWorkers, func(i int) {
+		old[i] = olderThan(entries[i].path, deadline)
+	})
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return
+	}
+	for i, e := range entries {
+		if !old[i] || !c.isCurrent(e.item, e.path) || !olderThan(e.path, deadline) {
+			continue // Young, or replaced or written since it was stat'ed.
+		}
+		if err := c.evict(e.item); err != nil {
+			c.logf("stash: janitor failed to evict %q: %v", e.item.Value.(*Meta).Key, err) // The next sweep tries again.
+		}
+	}
+}
+
+// olderThan reports whether the file at path was last written before deadline.
+func olderThan(path string, deadline time.Time) bool {
+	s, err := os.Stat(path)
+	return err == nil && s.ModTime().Before(deadline)
+}
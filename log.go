@@ -0,0 +1,21 @@
+package stash
+
+import "fmt"
+
+// Logger receives diagnostics from a Cache, such as evictions and rejected blobs. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf records a line for the logger, if any. Lines are passed to the logger by notifyEvicted once the lock is released, so that the logger may take its time, or even use the cache, without blocking it. The caller must hold the write lock.
+func (c *Cache) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logs = append(c.logs, fmt.Sprintf(format, v...))
+	}
+}
+
+// reject logs err as the reason the blob of key was not added, and returns it.
+func (c *Cache) reject(key string, err error) error {
+	c.logf("stash: rejected %q: %v", key, err)
+	return err
+}
@@ -0,0 +1,67 @@
+package stash
+
+import "container/list"
+
+// memTier holds the most recently used blobs in memory, decompressed, up to a total size. It only ever holds copies of blobs on disk, so it can be dropped at any time.
+type memTier struct {
+	size int64 // Total size of blobs allowed
+	used int64 // Total size of blobs added
+
+	l *list.List               // List of blobs, most recently used first
+	m map[string]*list.Element // Map of blobs in list by key
+}
+
+type memEntry struct {
+	key string
+	b   []byte
+}
+
+func newMemTier(size int64) *memTier {
+	return &memTier{
+		size: size,
+		l:    list.New(),
+		m:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the blob of the given key, if held, and marks it as most recently used.
+func (t *memTier) get(key string) ([]byte, bool) {
+	item, ok := t.m[key]
+	if !ok {
+		return nil, false
+	}
+	t.l.MoveToFront(item)
+	return item.Value.(*memEntry).b, true
+}
+
+// add holds the blob of the given key, dropping the least recently used blobs to make room. Blobs larger than the tier are not held.
+func (t *memTier) add(key string, b []byte) {
+	t.remove(key)
+	if int64(len(b)) > t.size {
+		return
+	}
+
+	t.m[key] = t.l.PushFront(&memEntry{key, b})
+	t.used += int64(len(b))
+	for t.used > t.size {
+		t.remove(t.l.Back().Value.(*memEntry).key)
+	}
+}
+
+// remove drops the blob of the given key, if held.
+func (t *memTier) remove(key string) {
+	item, ok := t.m[key]
+	if !ok {
+		return
+	}
+	t.used -= int64(len(item.Value.(*memEntry).b))
+	delete(t.m, key)
+	t.l.Remove(item)
+}
+
+// clear drops every blob.
+func (t *memTier) clear() {
+	t.used = 0
+	t.l = list.New()
+	t.m = make(map[string]*list.Element)
+}
@@ -0,0 +1,39 @@
+package stash
+
+import "sync/atomic"
+
+// Metrics receives counts from a Cache, for export to a metrics system such as Prometheus. The cache calls it as events happen, possibly with its lock held, so implementations must be safe for concurrent use, quick, and must not use the cache.
+type Metrics interface {
+	IncHit()                   // A Get found the blob
+	IncMiss()                  // A Get did not find the blob, or found it gone or corrupt
+	IncEviction()              // An entry was removed to make room for others
+	ObservePutSize(size int64) // A blob of the given size on disk was added
+}
+
+// noMetrics is the Metrics of a cache without WithMetrics.
+type noMetrics struct{}
+
+func (noMetrics) IncHit()              {}
+func (noMetrics) IncMiss()             {}
+func (noMetrics) IncEviction()         {}
+func (noMetrics) ObservePutSize(int64) {}
+
+func (c *Cache) countHit() {
+	atomic.AddInt64(&c.stats.Hits, 1)
+	c.metrics.IncHit()
+}
+
+func (c *Cache) countMiss() {
+	atomic.AddInt64(&c.stats.Misses, 1)
+	c.metrics.IncMiss()
+}
+
+func (c *Cache) countEviction() {
+	atomic.AddInt64(&c.stats.Evictions, 1)
+	c.metrics.IncEviction()
+}
+
+func (c *Cache) countPut(size int64) {
+	atomic.AddInt64(&c.stats.Puts, 1)
+	c.metrics.ObservePutSize(size)
+}
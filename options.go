@@ -0,0 +1,187 @@
+package stash
+
+import "os"
+
+// Option configures a Cache created by New.
+type Option func(*Cache)
+
+// WithMaxSize sets the total size of files the cache allows. It is required.
+func WithMaxSize(size int64) Option {
+	return func(c *Cache) {
+		c.size = size
+	}
+}
+
+// WithMaxEntries sets the total number of files the cache allows. It is required.
+func WithMaxEntries(cap int64) Option {
+	return func(c *Cache) {
+		c.cap = cap
+	}
+}
+
+// WithMaxEntrySize sets the size of the largest file the cache allows. Larger blobs are rejected with ErrTooLarge however much space is available, so that no single blob can evict everything else. By default a blob may take up the whole cache.
+func WithMaxEntrySize(size int64) Option {
+	return func(c *Cache) {
+		c.entrySize = size
+	}
+}
+
+// WithPolicy sets the policy deciding which blob the cache evicts first. It defaults to LRU.
+func WithPolicy(policy Policy) Option {
+	return func(c *Cache) {
+		c.policy = policy
+	}
+}
+
+// WithDeflate enables compressing blobs by lz4 for reduce disk usage. It is a shorthand for WithCodec(LZ4).
+func WithDeflate(useDeflate bool) Option {
+	return func(c *Cache) {
+		if useDeflate {
+			c.codec = LZ4
+		} else {
+			c.codec = nil
+		}
+	}
+}
+
+// WithLogicalSize makes WithMaxSize and WithMaxEntrySize limit the size of blobs before compression rather than the size of their files on disk, which is the default. Either way, Stats reports both. Compressed blobs whose size before compression is unknown, e.g. ones adopted by Warmup, count as the size of their files.
+func WithLogicalSize(logical bool) Option {
+	return func(c *Cache) {
+		c.logical = logical
+	}
+}
+
+// WithCompressionLevel sets the level at which the LZ4 codec compresses blobs, trading CPU for disk usage. Level 0, the default, is the fastest. Higher levels switch to the slower high-compression mode of lz4, which tries up to that many earlier matches for every sequence and compresses better the higher the level, up to 65536. Levels outside 0 to 65536 are clamped. The level only applies to LZ4, e.g. with WithDeflate, and is ignored if WithCodec sets any other codec. Blobs are read back the same whatever the level they were written at.
+func WithCompressionLevel(level int) Option {
+	return func(c *Cache) {
+		if level < 0 {
+			level = 0
+		}
+		if level > maxCompressionLevel {
+			level = maxCompressionLevel
+		}
+		c.level = level
+	}
+}
+
+// WithDeflateMinSize makes the cache store blobs smaller than size bytes as they are, and only compress larger ones. Compressing small blobs costs CPU for little gain, and the framing of lz4 may even grow them. Whether a blob was compressed is recorded in Meta.Compressed. By default, every blob is compressed if compression is enabled.
+func WithDeflateMinSize(size int64) Option {
+	return func(c *Cache) {
+		c.minDeflate = size
+	}
+}
+
+// WithCodec sets the codec used to compress blobs on disk. A nil codec stores blobs as they are.
+func WithCodec(codec Codec) Option {
+	return func(c *Cache) {
+		c.codec = codec
+	}
+}
+
+// WithWriteOnce makes the cache never replace a blob: putting a key that is already in the cache fails with ErrAlreadyExists and leaves the existing blob untouched. This suits immutable or content-addressed data.
+func WithWriteOnce(writeOnce bool) Option {
+	return func(c *Cache) {
+		c.writeOnce = writeOnce
+	}
+}
+
+// WithVerify makes Get check every blob against the checksum recorded when it was added, failing with ErrCorrupt on a mismatch. Checking reads the blob in full before Get returns. Blobs adopted by Warmup have no checksum and are not checked.
+func WithVerify(verify bool) Option {
+	return func(c *Cache) {
+		c.verify = verify
+	}
+}
+
+// WithHashedNames names files by the SHA-256 of their key instead of the escaped key. Escaped keys grow with the key and may exceed the filename limit of the operating system, while hashes have a fixed length. The original keys are recorded in a names file within the directory, so that Warmup can restore them.
+func WithHashedNames(hashNames bool) Option {
+	return func(c *Cache) {
+		c.hashNames = hashNames
+	}
+}
+
+// WithIndex makes Close save the entries of the cache to an index file, and New restore them from it in a single read. If there is no index file, e.g. after a crash, New falls back to Warmup.
+func WithIndex(useIndex bool) Option {
+	return func(c *Cache) {
+		c.useIndex = useIndex
+	}
+}
+
+// WithOnEvict sets a hook called with the key and size of every blob evicted to make room for others. It is called once the operation causing the eviction has released the lock of the cache, so it may use the cache itself.
+func WithOnEvict(onEvict func(key string, size int64)) Option {
+	return func(c *Cache) {
+		c.onEvict = onEvict
+	}
+}
+
+// WithLogger sets a logger for diagnostics, such as evictions, rejected blobs, and entries dropped because their files went missing, expired or were corrupt. Lines are logged once the operation causing them has released the lock of the cache. By default, nothing is logged.
+func WithLogger(logger Logger) Option {
+	return func(c *Cache) {
+		c.logger = logger
+	}
+}
+
+// WithMetrics sets the Metrics the cache reports hits, misses, evictions and the sizes of added blobs to. By default, they are only counted in Stats.
+func WithMetrics(metrics Metrics) Option {
+	return func(c *Cache) {
+		c.metrics = metrics
+	}
+}
+
+// WithFileMode sets the permissions of the files the cache creates, e.g. 0600 to keep blobs private to their owner. As with os.OpenFile, the umask of the process applies, except to files moved into the cache by PutFile or written by PutWriter, which are given the permissions as they are. By default, files are created with 0666 before the umask, and PutFile and PutWriter leave permissions alone.
+func WithFileMode(mode os.FileMode) Option {
+	return func(c *Cache) {
+		c.fileMode = mode.Perm()
+	}
+}
+
+// WithDirMode sets the permissions of the directories the cache creates, such as those of WithKeyToPath, namespaces and NewSharded. As with os.MkdirAll, the umask of the process applies. By default, directories are created with 0777 before the umask.
+func WithDirMode(mode os.FileMode) Option {
+	return func(c *Cache) {
+		c.dirMode = mode.Perm()
+	}
+}
+
+// WithTempDir makes the cache write blobs to files in dir, e.g. on a tmpfs, before moving them into the storage directory. By default, they are written next to where they end up. Moving a file is only an atomic rename within a filesystem: across filesystems, a blob is copied into the storage directory, under a temporary name renamed into place once complete, so readers still never see it partially written, but every write costs a second one, and a crash may leave the copy behind.
+func WithTempDir(dir string) Option {
+	return func(c *Cache) {
+		c.tempDir = dir
+	}
+}
+
+// WithMemoryTier keeps the most recently used blobs of up to size bytes in total in memory, decompressed, so that Get serves them without touching the disk. Blobs are kept in memory on a Get from disk, and only if they fit. The disk remains the source of truth: the memory tier only holds copies. With NewSharded, every shard has a memory tier of its own of this size.
+func WithMemoryTier(size int64) Option {
+	return func(c *Cache) {
+		if size > 0 {
+			c.mem = newMemTier(size)
+		} else {
+			c.mem = nil
+		}
+	}
+}
+
+// WithKeyToPath sets the function mapping the escaped key of a blob, or its hash with WithHashedNames, to the path of its file relative to the storage directory. Paths may use slashes to spread files over subdirectories, e.g. "ab/cd/abcdef" for "abcdef", which keeps directories small when there are millions of blobs. Subdirectories are created as needed and walked by Warmup; they are not removed once empty. As keys cannot be told from such paths, they are recorded in a names file, as with WithHashedNames. A path that would leave the storage directory, or whose elements start with "@", is rejected with ErrBadKey. By default, files are stored directly in the storage directory.
+func WithKeyToPath(keyToPath func(escapedKey string) string) Option {
+	return func(c *Cache) {
+		c.keyToPath = keyToPath
+	}
+}
+
+// WithMinFreeSpace makes the cache leave at least size bytes free on the filesystem of its storage directory, however much room the limits of the cache leave. After writing a blob, the cache evicts entries until the filesystem has enough free space again; if it runs out of entries to evict, the blob is rejected with ErrNoSpace. Free space is only known on Linux, macOS, FreeBSD and DragonFly BSD, and not checked elsewhere.
+func WithMinFreeSpace(size int64) Option {
+	return func(c *Cache) {
+		c.minFree = size
+	}
+}
+
+// defaultWarmupWorkers is the number of files Warmup stats at a time unless set by WithWarmupConcurrency.
+const defaultWarmupWorkers = 8
+
+// WithWarmupConcurrency sets the number of files Warmup stats at a time, and then reads at a time to find their headers and whether they are compressed. Accessing files in parallel speeds up Warmup of large directories on network filesystems; the order of the entries does not depend on it. It defaults to 8, and values below 1 count as 1.
+func WithWarmupConcurrency(n int) Option {
+	return func(c *Cache) {
+		if n < 1 {
+			n = 1
+		}
+		c.warmupWorkers = n
+	}
+}
@@ -0,0 +1,126 @@
+package stash
+
+import "container/list"
+
+// Policy decides which entry a Cache evicts first. The cache keeps its entries in a list and always evicts from the back of it; a policy decides where entries go in the list when they are added and when they are read.
+type Policy interface {
+	// Add inserts a new entry into the list and returns its element.
+	Add(l *list.List, m *Meta) *list.Element
+
+	// Touch records a read of the entry of e.
+	Touch(l *list.List, e *list.Element)
+}
+
+var (
+	// LRU evicts the least recently used entry first. It is the default.
+	LRU Policy = lru{}
+
+	// LFU evicts the least frequently used entry first, and the least recently used one among equally frequent entries.
+	LFU Policy = lfu{}
+
+	// FIFO evicts the oldest entry first. Reads do not reorder entries.
+	FIFO Policy = fifo{}
+)
+
+// evictionPlan decides which entries of l to evict, taking them from the back, for n more bytes in the given number of additional entries to fit in a cache of the given size and cap. Entries count for sizeOf bytes; sizeUsed and capUsed describe the entries in l. Entries whose files could not be removed by the last eviction are skipped. It returns the keys of the entries in the order they are to be evicted, and changes nothing.
+func evictionPlan(l *list.List, sizeOf func(*Meta) int64, sizeUsed, capUsed, size, cap, n, entries int64) []string {
+	var keys []string
+	for item := l.Back(); item != nil && (sizeUsed+n > size || capUsed+entries > cap); item = item.Prev() {
+		m := item.Value.(*Meta)
+		if m.stuck != nil {
+			continue
+		}
+		keys = append(keys, m.Key)
+		sizeUsed -= sizeOf(m)
+		capUsed--
+	}
+	return keys
+}
+
+type lru struct{}
+
+func (lru) Add(l *list.List, m *Meta) *list.Element {
+	return l.PushFront(m)
+}
+
+func (lru) Touch(l *list.List, e *list.Element) {
+	l.MoveToFront(e)
+}
+
+// lfu keeps the list sorted by frequency, the most frequently used entries in front, so that entries of the same frequency form a run, the most recently used in front. Each entry points to the run it is in, which knows its front, so that entries are placed in constant time.
+type lfu struct{}
+
+// lfuRun is a run of entries of the same frequency.
+type lfuRun struct {
+	head *list.Element // Front entry of the run
+}
+
+func (lfu) Add(l *list.List, m *Meta) *list.Element {
+	m.freq = 1
+	if back := l.Back(); back != nil && back.Value.(*Meta).freq == 1 {
+		r := back.Value.(*Meta).run
+		m.run = r
+		r.head = l.InsertBefore(m, r.head)
+		return r.head
+	}
+	e := l.PushBack(m)
+	m.run = &lfuRun{e}
+	return e
+}
+
+func (p lfu) Touch(l *list.List, e *list.Element) {
+	m := e.Value.(*Meta)
+	r := m.run
+	front := r.head.Prev() // Back entry of the run in front of r
+	p.leave(e)
+	m.freq++
+
+	if front != nil && front.Value.(*Meta).freq == m.freq {
+		m.run = front.Value.(*Meta).run
+		l.MoveBefore(e, m.run.head)
+		m.run.head = e
+		return
+	}
+	// Start a run of its own between r and the one in front of it.
+	if front != nil {
+		l.MoveAfter(e, front)
+	} else {
+		l.MoveToFront(e)
+	}
+	m.run = &lfuRun{e}
+}
+
+// remove takes e out of l, keeping the run it was in intact.
+func (p lfu) remove(l *list.List, e *list.Element) {
+	p.leave(e)
+	l.Remove(e)
+}
+
+// leave takes e out of its run, before it moves. Should e be the front of the run, the entry behind it takes over, which is in the same run unless the run is left empty, and with it unused.
+func (lfu) leave(e *list.Element) {
+	if r := e.Value.(*Meta).run; r.head == e {
+		r.head = e.Next()
+	}
+}
+
+// remover is implemented by policies that need to know when an entry is removed from the list.
+type remover interface {
+	remove(l *list.List, e *list.Element)
+}
+
+// removeElement removes e from l, letting policy know if it needs to.
+func removeElement(policy Policy, l *list.List, e *list.Element) {
+	if p, ok := policy.(remover); ok {
+		p.remove(l, e)
+		return
+	}
+	l.Remove(e)
+}
+
+type fifo struct{}
+
+func (fifo) Add(l *list.List, m *Meta) *list.Element {
+	return l.PushFront(m)
+}
+
+func (fifo) Touch(l *list.List, e *list.Element) {}
@@ -0,0 +1,69 @@
+package stash
+
+import "os"
+
+// trackedFile is a file opened by the cache, which keeps count of the readers of each file.
+type trackedFile struct {
+	*os.File
+	c      *Cache
+	closed bool
+}
+
+// track counts f as open until the returned file is closed.
+func (c *Cache) track(f *os.File) *trackedFile {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	if c.readers == nil {
+		c.readers = make(map[string]int)
+	}
+	c.readers[f.Name()]++
+	return &trackedFile{f, c, false}
+}
+
+func (t *trackedFile) Close() error {
+	if t.closed {
+		return t.File.Close() // Fails with os.ErrClosed.
+	}
+	t.closed = true
+	err := t.File.Close()
+
+	c := t.c
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	path := t.Name()
+	c.readers[path]--
+	if c.readers[path] > 0 {
+		return err
+	}
+	delete(c.readers, path)
+	if c.unlinks[path] {
+		delete(c.unlinks, path)
+		os.Remove(path)
+	}
+	return err
+}
+
+// deferUnlink reports whether path has open readers, and if so, marks it to be deleted once they are closed.
+func (c *Cache) deferUnlink(path string) bool {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	if c.readers[path] == 0 {
+		return false
+	}
+	if c.unlinks == nil {
+		c.unlinks = make(map[string]bool)
+	}
+	c.unlinks[path] = true
+	return true
+}
+
+// keepFile cancels the deletion of path deferred by deferUnlink, as it holds a new blob.
+func (c *Cache) keepFile(path string) {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	delete(c.unlinks, path)
+}
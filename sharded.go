@@ -0,0 +1,132 @@
+package stash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Sharded spreads blobs over several Caches by a hash of their key. Each shard has its own lock and subdirectory, so operations on different shards do not contend.
+type Sharded struct {
+	shards []*Cache
+}
+
+// NewSharded creates a Sharded cache backed by the given number of subdirectories of dir. The size and entry limits set by the options apply to the whole, and are divided evenly across the shards; ErrTooManyShards is returned if that leaves a shard with nothing.
+func NewSharded(dir string, shards int, opts ...Option) (*Sharded, error) {
+	if !validDir(dir) {
+		return nil, ErrBadDir
+	}
+	if shards <= 0 {
+		return nil, ErrBadShards
+	}
+
+	limits := &Cache{}
+	for _, opt := range opts {
+		opt(limits)
+	}
+	size, cap := limits.size/int64(shards), limits.cap/int64(shards)
+	if limits.size > 0 && size == 0 || limits.cap > 0 && cap == 0 {
+		return nil, ErrTooManyShards
+	}
+	opts = append(opts[:len(opts):len(opts)], WithMaxSize(size), WithMaxEntries(cap))
+
+	s := &Sharded{shards: make([]*Cache, 0, shards)}
+	for i := 0; i < shards; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("%02x", i))
+		if err := os.MkdirAll(sub, limits.dirPerm()); err != nil {
+			s.Close() // Release the shards created so far.
+			return nil, &FileError{sub, "", err}
+		}
+		c, err := New(sub, opts...)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, c)
+	}
+	return s, nil
+}
+
+// shard returns the Cache responsible for the given key.
+func (s *Sharded) shard(key string) *Cache {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Warmup adopts the files already present in the subdirectories of every shard.
+func (s *Sharded) Warmup() error {
+	for _, c := range s.shards {
+		if err := c.Warmup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every shard, as Cache.Close does, and returns the first error. All shards are closed even if some fail.
+func (s *Sharded) Close() error {
+	var err error
+	for _, c := range s.shards {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Put adds a byte slice as a blob to the cache against the given key.
+func (s *Sharded) Put(key string, val []byte) error {
+	return s.shard(key).Put(key, val)
+}
+
+// PutReader adds the contents of a reader as a blob to the cache against the given key.
+func (s *Sharded) PutReader(key string, r io.Reader) error {
+	return s.shard(key).PutReader(key, r)
+}
+
+// Get returns a reader for a blob in the cache, or ErrNotFound otherwise.
+func (s *Sharded) Get(key string) (io.ReadCloser, error) {
+	return s.shard(key).Get(key)
+}
+
+// Has reports whether the cache holds a blob against the given key.
+func (s *Sharded) Has(key string) bool {
+	return s.shard(key).Has(key)
+}
+
+// Delete removes a blob from the cache, or returns ErrNotFound if there is none against the given key.
+func (s *Sharded) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+// Keys returns a sorted list of keys across all shards.
+func (s *Sharded) Keys() []string {
+	keys := []string{}
+	for _, c := range s.shards {
+		keys = append(keys, c.Keys()...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Size returns the total size of the blobs across all shards.
+func (s *Sharded) Size() int64 {
+	n := int64(0)
+	for _, c := range s.shards {
+		n += c.Size()
+	}
+	return n
+}
+
+// Len returns the number of blobs across all shards.
+func (s *Sharded) Len() int64 {
+	n := int64(0)
+	for _, c := range s.shards {
+		n += c.Len()
+	}
+	return n
+}
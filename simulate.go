@@ -0,0 +1,70 @@
+package stash
+
+import "container/list"
+
+// SimOp is a read of a blob in a workload replayed by Simulate.
+type SimOp struct {
+	Key  string
+	Size int64 // Size of the blob, added to the cache if the read misses
+}
+
+// SimResult holds the outcome of a workload replayed by Simulate.
+type SimResult struct {
+	Hits      int64 // Number of reads that found the blob
+	Misses    int64 // Number of reads that did not find the blob
+	Evictions int64 // Number of blobs removed to make room for others
+	Rejected  int64 // Number of blobs too large to be added
+}
+
+// HitRate returns the fraction of reads that found the blob, or 0 if there were none.
+func (r SimResult) HitRate() float64 {
+	if r.Hits+r.Misses == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Hits+r.Misses)
+}
+
+// Simulate replays a workload against a cache of the given size and cap, without touching the disk, to help choose the limits of a cache before deploying it. Every op reads a blob; a read that misses adds the blob, as GetOrLoad would. Eviction follows the same rules as a Cache created with the given options; of them, only WithPolicy and WithMaxEntrySize have any effect. Sizes are those of the blobs as stored, i.e. after compression.
+func Simulate(size, cap int64, ops []SimOp, opts ...Option) SimResult {
+	c := &Cache{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.size = size
+	c.cap = cap
+	if c.policy == nil {
+		c.policy = LRU
+	}
+
+	var (
+		r        SimResult
+		l        = list.New()
+		m        = make(map[string]*list.Element)
+		sizeUsed int64
+		capUsed  int64
+	)
+	for _, op := range ops {
+		if item, ok := m[op.Key]; ok {
+			r.Hits++
+			c.policy.Touch(l, item)
+			continue
+		}
+		r.Misses++
+		if op.Size > c.maxEntrySize() || cap <= 0 {
+			r.Rejected++
+			continue
+		}
+		for _, key := range evictionPlan(l, c.sizeOf, sizeUsed, capUsed, size, cap, op.Size, 1) {
+			item := m[key]
+			sizeUsed -= item.Value.(*Meta).Size
+			capUsed--
+			delete(m, key)
+			removeElement(c.policy, l, item)
+			r.Evictions++
+		}
+		m[op.Key] = c.policy.Add(l, &Meta{Key: op.Key, Size: op.Size, Length: op.Size})
+		sizeUsed += op.Size
+		capUsed++
+	}
+	return r
+}
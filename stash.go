@@ -3,238 +3,2085 @@ package stash
 import (
 	"bytes"
 	"container/list"
+	"context"
+	"encoding/json"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Meta struct {
-	Key  string
-	Size int64
-	Path string
+	Key        string    // Original, unescaped key
+	Size       int64     // Size of the file on disk, after compression
+	Length     int64     // Size of the blob before compression, or Size if unknown, e.g. for compressed files adopted by Warmup
+	Path       string    // Path to the file on disk
+	Expires    time.Time // Time after which the entry is stale, zero if never
+	LastAccess time.Time // Time of the last Get promoting the entry, or of adding it if none
+
+	Checksum   uint32            // CRC-32 of the blob before compression, zero if unknown
+	Compressed bool              // Whether the file is compressed by the codec
+	Header     map[string]string // User metadata set by PutWithMeta, nil if none
+
+	freq  int64   // Number of uses, maintained by LFU
+	run   *lfuRun // Run of entries of the same frequency, maintained by LFU
+	stuck error   // Why the file could not be removed on eviction, which skips the entry until the next eviction
+}
+
+func (m *Meta) expired() bool {
+	return !m.Expires.IsZero() && time.Now().After(m.Expires)
+}
+
+// copyMeta returns a copy of m that shares no state with it.
+func copyMeta(m *Meta) Meta {
+	cm := *m
+	if m.Header != nil {
+		cm.Header = make(map[string]string, len(m.Header))
+		for k, v := range m.Header {
+			cm.Header[k] = v
+		}
+	}
+	return cm
 }
 
 type Cache struct {
+	// Stats reads these without the lock, so they are only written atomically. They come first to be 64-bit aligned on 32-bit platforms.
+	stats      Stats // Counters reported by Stats
+	sizeUsed   int64 // Total size of files added
+	lengthUsed int64 // Total size of blobs added, before compression
+
 	dir  string // Path to storage directory
 	size int64  // Total size of files allowed
 	cap  int64  // Total number of files allowed
 
-	sizeUsed int64 // Total size of files added
-	capUsed  int64 // Total number of files added
+	entrySize int64 // Size of a single file allowed, zero if only limited by size
+	minFree   int64 // Free space to leave on the filesystem, zero if none
+
+	capUsed int64 // Total number of files added
+
+	list   *list.List               // List of items in cache
+	m      map[string]*list.Element // Map of items in list
+	files  map[string]string        // Keys of items by path of file
+	policy Policy                   // Policy ordering the list
+
+	codec      Codec // Codec for compressing blobs, nil if disabled
+	level      int   // Compression level of LZ4
+	minDeflate int64 // Size of the smallest blob compressed
+	logical    bool  // Apply the size limits to blobs before compression
+
+	fileMode  os.FileMode // Permissions of new files, zero for the default
+	dirMode   os.FileMode // Permissions of new directories, zero for the default
+	tempDir   string      // Directory of files being written, empty for next to their destination
+	writeOnce bool        // Reject overwrites of existing keys
+	verify    bool        // Verify checksums on Get
+	hashNames bool        // Name files by the hash of their key
+	useIndex  bool        // Persist entries in an index file on Close
+
+	keyToPath func(string) string // Maps escaped keys to paths of files, nil for a flat layout
+
+	warmupWorkers int // Number of files Warmup stats and reads at a time
+
+	mem *memTier // Blobs held in memory, nil if disabled
 
-	list *list.List               // List of items in cache
-	m    map[string]*list.Element // Map of items in list
+	opts       []Option          // Options the cache was created with
+	namespaces map[string]*Cache // Caches returned by Namespace
 
-	useDeflate bool // Use lz4 deflate or not
+	closed bool // Set by Close
+
+	fallbacks []Fallback // Sources consulted on a miss
+
+	onEvict func(key string, size int64) // Hook called for evicted entries
+	evicted []Meta                       // Evicted entries not yet passed to onEvict
+	collect bool                         // Collect evicted entries even without onEvict, for PutEx
+	stuck   []*Meta                      // Entries marked stuck by the last eviction
+
+	logger Logger   // Logger for diagnostics, nil if disabled
+	logs   []string // Lines not yet passed to logger
+
+	metrics Metrics // Metrics to report events to
+
+	loads flight // Loads in progress by GetOrLoad
+
+	readers map[string]int  // Number of open readers by path
+	unlinks map[string]bool // Paths to delete once their last reader is closed
+	rl      sync.Mutex      // Lock for readers and unlinks, which closing readers take without l
+
+	janitor chan struct{} // Closed to stop the janitor, nil if not running
+
+	writers map[*putWriter]bool // Writers returned by PutWriter not closed yet
 
 	l sync.RWMutex
 }
 
-// New creates a Cache backed by dir on disk. The cache allows at most "cap" files of total size "size". If "useDeflate" is true, blobs will be compressed by lz4 for reduce disk usage.
-func New(dir string, size, cap int64, useDeflate bool) (*Cache, error) {
+// Fallback returns the blob for the given key from an alternate source, such as a replica or a slower storage tier.
+type Fallback func(key string) (io.ReadCloser, error)
+
+// New creates a Cache backed by dir on disk, configured by the given options. The cache allows at most WithMaxEntries files of total size WithMaxSize; both must be set. The directory is created if missing; if it cannot be created or written to, New fails with a *FileError matching ErrBadDir.
+func New(dir string, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		list:          list.New(),
+		m:             make(map[string]*list.Element),
+		files:         make(map[string]string),
+		opts:          opts,
+		warmupWorkers: defaultWarmupWorkers,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.policy == nil {
+		c.policy = LRU
+	}
+	if c.metrics == nil {
+		c.metrics = noMetrics{}
+	}
+	if _, ok := c.codec.(lz4Codec); ok {
+		c.codec = lz4Codec{c.level}
+	}
+
 	if !validDir(dir) {
 		return nil, ErrBadDir
 	}
-	if size <= 0 {
+	if c.size <= 0 {
 		return nil, ErrBadSize
 	}
-	if cap <= 0 {
+	if c.cap <= 0 {
 		return nil, ErrBadCap
 	}
 
-	dir = strings.TrimRight(dir, string(os.PathSeparator)) // Clean path to dir
+	c.dir = strings.TrimRight(dir, string(os.PathSeparator)) // Clean path to dir
+	if err := c.checkDir(); err != nil {
+		return nil, err
+	}
+
+	if c.useIndex {
+		ok, err := c.readIndex()
+		c.notifyEvicted()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if err := c.Warmup(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c, nil
+}
 
-	return &Cache{
-		dir:        dir,
-		size:       size,
-		cap:        cap,
-		list:       list.New(),
-		m:          make(map[string]*list.Element),
-		useDeflate: useDeflate,
-	}, nil
+// NewCache creates a Cache backed by dir on disk. The cache allows at most "cap" files of total size "size". If "useDeflate" is true, blobs will be compressed by lz4 for reduce disk usage.
+//
+// Deprecated: Use New with WithMaxSize, WithMaxEntries and WithDeflate instead.
+func NewCache(dir string, size, cap int64, useDeflate bool) (*Cache, error) {
+	return New(dir, WithMaxSize(size), WithMaxEntries(cap), WithDeflate(useDeflate))
 }
 
-func (c *Cache) Warmup() error {
+// NewWriteOnce is like NewCache, but the returned Cache never replaces a blob: putting a key that is already in the cache fails with ErrAlreadyExists and leaves the existing blob untouched. This suits immutable or content-addressed data.
+//
+// Deprecated: Use New with WithWriteOnce instead.
+func NewWriteOnce(dir string, size, cap int64, useDeflate bool) (*Cache, error) {
+	return New(dir, WithMaxSize(size), WithMaxEntries(cap), WithDeflate(useDeflate), WithWriteOnce(true))
+}
+
+// Close releases the resources of the cache. The janitor is stopped, blobs still being written by PutWriter and ephemeral blobs are discarded, and with WithIndex, the entries of the cache are saved for the next New to restore. Once closed, operations on the cache fail with ErrClosed.
+func (c *Cache) Close() error {
 	c.l.Lock()
 	defer c.l.Unlock()
 
-	f, err := os.Open(c.dir)
-	if err != nil {
-		return err
+	if c.closed {
+		return ErrClosed
 	}
-	fileInfo, err := f.Readdir(-1)
-	f.Close()
-	if err != nil {
-		return err
+
+	var err error
+	for item := c.list.Front(); item != nil; {
+		next := item.Next()
+		if m := item.Value.(*Meta); isEphemeral(filepath.Base(m.Path)) {
+			if e := c.remove(item); e != nil && err == nil {
+				err = &FileError{c.dir, m.Key, e}
+			}
+		}
+		item = next
 	}
+	c.closed = true
+	c.stopJanitor()
+	for w := range c.writers {
+		os.Remove(w.f.Name()) // Closing the writer later fails with ErrClosed.
+	}
+	c.writers = nil
 
-	for _, file := range fileInfo {
-		key := file.Name()
-		path := filepath.Join(c.dir, key)
-		c.addMeta(key, path, file.Size())
+	for _, ns := range c.namespaces {
+		if e := ns.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
 
-	return nil
+	if c.useIndex {
+		if e := c.writeIndex(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
-// Put adds a byte slice as a blob to the cache against the given key.
-func (c *Cache) Put(key string, val []byte) error {
-	return c.PutReader(key, bytes.NewReader(val))
+// Warmup adds the blobs found in the storage directory to the cache, least recently modified first. Blobs the cache already holds are left as they are, so Warmup may be called again at any time to pick up files added behind the cache's back. Files compressed with LZ4 are recognised as such whether or not the cache compresses blobs, so the directory may mix compressed and raw blobs, e.g. from runs with different settings. Failures to access the storage directory are reported as a *FileError.
+func (c *Cache) Warmup() error {
+	return c.WarmupSince(time.Time{})
 }
 
-// PutReader adds the contents of a reader as a blob to the cache against the given key.
-func (c *Cache) PutReader(key string, r io.Reader) error {
+// WarmupSince is like Warmup, but only adds blobs whose files were modified after cutoff, and deletes the older ones from disk instead, so that long unused blobs do not come back to life. A zero cutoff keeps all blobs, as Warmup does. Blobs the cache already holds are left as they are, however old.
+func (c *Cache) WarmupSince(cutoff time.Time) error {
+	defer c.notifyEvicted()
 	c.l.Lock()
 	defer c.l.Unlock()
 
-	path, n, err := writeFile(c.dir, escape(key), r, c.useDeflate)
+	if c.closed {
+		return ErrClosed
+	}
+
+	files, err := listFiles(c.dir, c.keyToPath != nil, c.warmupWorkers)
 	if err != nil {
-		return err
+		return &FileError{c.dir, "", err}
 	}
-	if err := c.validate(path, n); err != nil { // XXX(hjr265): We should validate before storing the file.
-		return err
+
+	// Add the least recently modified files first, so that the most recent ones end up at the front. Ties are broken by name, so that the order does not depend on the order of the stats.
+	sort.Slice(files, func(i, j int) bool {
+		if ti, tj := files[i].ModTime(), files[j].ModTime(); !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return files[i].name < files[j].name
+	})
+
+	var names map[string]string
+	if c.useNames() {
+		names, err = readNames(c.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	tracked := make(map[string]string, c.list.Len())
+	for item := c.list.Front(); item != nil; item = item.Next() {
+		m := item.Value.(*Meta)
+		tracked[m.Path] = m.Key
+	}
+
+	adopted := map[string]string{}
+	var adopts []dirFile
+	var keys, paths []string
+	for _, file := range files {
+		name := file.name
+		path := filepath.Join(c.dir, name)
+		if key, ok := tracked[path]; ok {
+			// Already in the cache, e.g. from an earlier Warmup; keep the entry as it is.
+			if !isEphemeral(file.Name()) {
+				adopted[name] = key
+			}
+			continue
+		}
+		if isEphemeral(file.Name()) {
+			// Ephemeral entries belong to a previous process; drop them instead of adopting them.
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return &FileError{c.dir, name, err}
+			}
+			os.Remove(headerPath(path))
+			c.logf("stash: removed %s: left over ephemeral file", name)
+			continue
+		}
+		var key string
+		if c.useNames() {
+			var ok bool
+			if key, ok = names[name]; !ok {
+				continue // Not a file written by the cache
+			}
+		} else if key, err = unescape(name); err != nil {
+			continue // Not a file written by the cache
+		}
+		if !cutoff.IsZero() && !file.ModTime().After(cutoff) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return &FileError{c.dir, name, err}
+			}
+			os.Remove(headerPath(path))
+			c.logf("stash: removed %s: modified before cutoff", name)
+			continue
+		}
+		adopts = append(adopts, file)
+		keys = append(keys, key)
+		paths = append(paths, path)
+	}
+
+	for i, p := range c.probeFiles(paths) {
+		if err := c.adopt(keys[i], paths[i], adopts[i], p); err != nil {
+			return err
+		}
+		adopted[adopts[i].name] = keys[i]
+	}
+
+	if c.useNames() {
+		return writeNames(c.dir, adopted, c.filePerm())
 	}
-	c.addMeta(escape(key), path, n)
 	return nil
 }
 
-// PutFile adds the contents of a file path as a blog to the cache. The source file will be moved or deleted.
-func (c *Cache) PutFile(key, srcpath string) error {
+// WarmupKeys adds the blobs of the given keys found in the storage directory to the cache, least recently modified first, as Warmup does. Rather than scanning the whole directory, it only stats the files of the given keys, which is much faster for large directories when the keys are known, e.g. from an index of their own. Keys without a file, and keys the cache already holds, are skipped. Failures to access the storage directory are reported as a *FileError.
+func (c *Cache) WarmupKeys(keys []string) error {
+	defer c.notifyEvicted()
 	c.l.Lock()
 	defer c.l.Unlock()
 
-	n, err := filesize(srcpath)
-	if err != nil {
-		return err
+	if c.closed {
+		return ErrClosed
 	}
-	path := filepath.Join(c.dir, escape(key))
-	if c.useDeflate {
-		w, err := os.Create(path)
+
+	var names, wanted []string
+	for _, key := range keys {
+		if _, ok := c.m[escape(key)]; ok {
+			continue
+		}
+		name, err := c.filename(key)
 		if err != nil {
 			return err
 		}
-		defer w.Close()
+		names = append(names, name)
+		wanted = append(wanted, key)
+	}
+	infos, err := statFiles(c.dir, names, c.warmupWorkers)
+	if err != nil {
+		return &FileError{c.dir, "", err}
+	}
 
-		r, err := os.Open(srcpath)
-		if err != nil {
-			return err
+	order := make([]int, 0, len(infos))
+	for i, info := range infos {
+		if info != nil && info.Mode().IsRegular() {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if ti, tj := infos[order[i]].ModTime(), infos[order[j]].ModTime(); !ti.Equal(tj) {
+			return ti.Before(tj)
 		}
-		defer r.Close()
+		return names[order[i]] < names[order[j]]
+	})
 
-		dw := NewDeflateWriter(w)
-		defer dw.Close()
-		n, err = io.Copy(dw, r)
-		if err != nil {
-			return err
+	paths := make([]string, len(order))
+	for j, i := range order {
+		paths[j] = filepath.Join(c.dir, names[i])
+	}
+	probes := c.probeFiles(paths)
+	for j, i := range order {
+		if _, ok := c.m[escape(wanted[i])]; ok {
+			continue // Listed twice
 		}
-		os.Remove(srcpath)
-	} else {
-		err = os.Rename(srcpath, path)
-		if err != nil {
+		if c.useNames() {
+			if err := appendName(c.dir, names[i], wanted[i], c.filePerm()); err != nil {
+				return err
+			}
+		}
+		if err := c.adopt(wanted[i], paths[j], infos[i], probes[j]); err != nil {
 			return err
 		}
 	}
-	if err := c.validate(path, n); err != nil { // XXX(hjr265): We should validate before storing the file.
-		return err
+	return nil
+}
+
+// adopt adds the file at path to the cache as the blob of key, last accessed when the file was last modified, as probed by probeFiles.
+func (c *Cache) adopt(key, path string, info os.FileInfo, p fileProbe) error {
+	if p.err != nil {
+		return p.err
 	}
-	c.addMeta(escape(key), path, n)
+	m := c.addMeta(key, path, info.Size(), info.Size())
+	m.Compressed = p.compressed
+	m.Header = p.header
+	m.LastAccess = info.ModTime()
 	return nil
 }
 
-// Get returns a reader for a blob in the cache, or ErrNotFound otherwise.
-func (c *Cache) Get(key string) (io.ReadCloser, error) {
-	c.l.RLock()
-	defer c.l.RUnlock()
+// Put adds a byte slice as a blob to the cache against the given key. Should the disk fill up, Put evicts entries to make room, beyond what the limits of the cache call for, and tries once more.
+func (c *Cache) Put(key string, val []byte) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
 
-	if item, ok := c.m[escape(key)]; ok {
-		c.list.MoveToFront(item)
-		path := item.Value.(*Meta).Path
-		if f, err := os.Open(path); err != nil {
-			return nil, err
-		} else {
-			if c.useDeflate {
-				return NewDeflateReader(f), nil
-			} else {
-				return f, nil
-			}
-		}
-	} else {
-		return nil, ErrNotFound
+	if c.closed {
+		return ErrClosed
 	}
+
+	return c.put(key, val)
 }
 
-// Keys returns a list of keys in the cache.
-func (c *Cache) Keys() []string {
-	keys := make([]string, len(c.m))
-	i := 0
-	for item := c.list.Back(); item != nil; item = item.Prev() {
-		keys[i] = item.Value.(*Meta).Key
-		i++
+// PutContent adds a byte slice as a blob to the cache against a key derived from its contents, the hex-encoded SHA-256 hash, and returns the key. If the cache already holds the same contents, PutContent only promotes them, as Get would, so identical blobs are stored once.
+func (c *Cache) PutContent(val []byte) (key string, err error) {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return "", ErrClosed
 	}
-	sort.Strings(keys)
-	return keys
+
+	key = contentKey(val)
+	if item, ok := c.m[escape(key)]; ok && !item.Value.(*Meta).expired() {
+		c.policy.Touch(c.list, item)
+		item.Value.(*Meta).LastAccess = time.Now()
+		return key, nil
+	}
+	if err := c.put(key, val); err != nil {
+		return "", err
+	}
+	return key, nil
 }
 
-// validate ensures the file satisfies the constraints of the cache.
-func (c *Cache) validate(path string, n int64) error {
-	if n > c.size {
-		os.Remove(path) // XXX(hjr265): We should not supress this error even if it is very unlikely.
-		return &FileError{c.dir, "", ErrTooLarge}
+// PutEx is like Put, but also returns the keys of the entries evicted to make room for the blob, in the order they were evicted.
+func (c *Cache) PutEx(key string, val []byte) (evicted []string, err error) {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
 	}
 
-	for n+c.sizeUsed > c.size {
-		err := c.evictLast()
-		if err != nil {
-			return err
+	start := len(c.evicted)
+	c.collect = true
+	err = c.put(key, val)
+	c.collect = false
+	for _, m := range c.evicted[start:] {
+		evicted = append(evicted, m.Key)
+	}
+	if c.onEvict == nil {
+		c.evicted = c.evicted[:start]
+	}
+	return evicted, err
+}
+
+// PutBatch adds byte slices as blobs to the cache against their keys, taking the lock only once. A failure to add one blob does not stop the others from being added; the failures are reported together in a *BatchError.
+func (c *Cache) PutBatch(items map[string][]byte) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := map[string]error{}
+	for _, key := range keys {
+		if err := c.put(key, items[key]); err != nil {
+			errs[key] = err
 		}
 	}
+	if len(errs) > 0 {
+		return &BatchError{errs}
+	}
+	return nil
+}
+
+// put stores a byte slice against the given key. If the disk runs out of space, entries are evicted until the blob would fit in the space they took up, and the write is retried once. The caller must hold the write lock.
+func (c *Cache) put(key string, val []byte) error {
+	if !c.compresses(int64(len(val))) && int64(len(val)) > c.maxEntrySize() { // Compressed blobs may still fit.
+		return c.reject(key, &FileError{c.dir, key, ErrTooLarge})
+	}
+	err := c.putReader(key, bytes.NewReader(val), false)
+	if !isNoSpace(err) {
+		return err
+	}
 
-	if c.capUsed+1 > c.cap {
-		err := c.evictLast()
+	for freed := int64(0); freed < int64(len(val)) && c.list.Len() > 0; {
+		n, err := c.evictLast()
 		if err != nil {
 			return err
 		}
+		freed += n
 	}
+	return c.putReader(key, bytes.NewReader(val), false)
+}
+
+// PutWithTTL adds a byte slice as a blob to the cache against the given key, valid for the given duration. Expired blobs are removed lazily: Get treats them as missing and removes them, but until then they still count towards Size and Len. Blobs adopted by Warmup never expire, as only WithIndex persists expiry.
+func (c *Cache) PutWithTTL(key string, val []byte, ttl time.Duration) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
 
+	if c.closed {
+		return ErrClosed
+	}
+
+	if err := c.put(key, val); err != nil {
+		return err
+	}
+	c.m[escape(key)].Value.(*Meta).Expires = time.Now().Add(ttl)
 	return nil
 }
 
-// evitLast removes the last file following the LRU policy.
-func (c *Cache) evictLast() error {
-	if last := c.list.Back(); last != nil {
-		item := last.Value.(*Meta)
-		if e := os.Remove(item.Path); e == nil {
-			c.sizeUsed -= item.Size
-			c.capUsed--
-			delete(c.m, item.Key)
-			c.list.Remove(last)
-			return nil
-		} else {
-			return e
-		}
+// PutWithMeta adds a byte slice as a blob to the cache against the given key, along with a header of user metadata, such as a content type or an ETag. The header is returned by Stat, and is saved next to the blob so that Warmup restores it.
+func (c *Cache) PutWithMeta(key string, val []byte, md map[string]string) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if err := c.put(key, val); err != nil {
+		return err
+	}
+	if len(md) == 0 {
+		return nil
 	}
 
+	h := make(map[string]string, len(md))
+	for k, v := range md {
+		h[k] = v
+	}
+	item := c.m[escape(key)]
+	m := item.Value.(*Meta)
+	if err := writeHeader(m.Path, h, c.filePerm()); err != nil {
+		c.remove(item)
+		return err
+	}
+	m.Header = h
 	return nil
 }
 
-// addMeta adds meta information to the cache.
-func (c *Cache) addMeta(key, path string, length int64) {
-	c.sizeUsed += length
-	c.capUsed++
-	if item, ok := c.m[key]; ok {
-		c.list.Remove(item)
+// PutReader adds the contents of a reader as a blob to the cache against the given key.
+func (c *Cache) PutReader(key string, r io.Reader) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
 	}
 
-	item := &Meta{
-		Key:  key,
-		Size: length,
-		Path: path,
+	return c.putReader(key, r, false)
+}
+
+// PutReaderContext is like PutReader, but stops copying when ctx is done. The partially written blob is discarded and the error of ctx is returned.
+func (c *Cache) PutReaderContext(ctx context.Context, key string, r io.Reader) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	err := c.putReader(key, &contextReader{ctx, r}, false)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// PutEphemeral adds a byte slice as a blob to the cache against the given key. The blob counts towards the limits of the cache like any other, but is not adopted by Warmup after a restart; Warmup removes it from disk instead.
+func (c *Cache) PutEphemeral(key string, val []byte) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	return c.putReader(key, bytes.NewReader(val), true)
+}
+
+// putReader stores the contents of a reader against the given key. The caller must hold the write lock.
+func (c *Cache) putReader(key string, r io.Reader, ephemeral bool) error {
+	if err := c.checkWriteOnce(key); err != nil {
+		return err
+	}
+
+	name, err := c.filename(key)
+	if err != nil {
+		return err
+	}
+	if ephemeral {
+		name = ephemeralName(name)
+	} else if c.useNames() {
+		if err := appendName(c.dir, name, key, c.filePerm()); err != nil {
+			return err
+		}
+	}
+	h := crc32.NewIEEE()
+	codec, r, err := c.compressor(io.TeeReader(r, h))
+	if err != nil {
+		return &FileError{c.dir, key, err}
+	}
+	path, n, length, err := c.writeFile(name, r, codec, c.maxEntrySize())
+	if err != nil {
+		return c.reject(key, err)
+	}
+	if err := c.validate(key, path, n, length); err != nil {
+		return err
+	}
+	m := c.addMeta(key, path, n, length)
+	m.Checksum = h.Sum32()
+	m.Compressed = codec != nil
+	c.countPut(n)
+	return nil
+}
+
+// Append adds extra to the end of the blob of the given key, evicting other entries if the grown blob no longer fits. A missing or expired key counts as an empty blob, so an expired blob is started afresh, without expiry. Uncompressed blobs are extended in place; compressed ones cannot be, so with a codec the whole blob is read back and compressed again.
+func (c *Cache) Append(key string, extra []byte) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	item, ok := c.m[escape(key)]
+	if !ok || item.Value.(*Meta).expired() {
+		return c.putReader(key, bytes.NewReader(extra), false)
+	}
+	if err := c.checkWriteOnce(key); err != nil {
+		return err
+	}
+	old := *item.Value.(*Meta)
+
+	if c.codec != nil || old.Compressed {
+		r, err := c.open(&old)
+		if err != nil {
+			return &FileError{c.dir, key, err}
+		}
+		err = c.putReader(key, io.MultiReader(r, bytes.NewReader(extra)), isEphemeral(filepath.Base(old.Path)))
+		r.Close()
+		if err != nil {
+			return err
+		}
+		m := c.m[escape(key)].Value.(*Meta)
+		m.Expires = old.Expires
+		return c.restoreHeader(m, old.Header)
+	}
+
+	n := old.Size + int64(len(extra))
+	if n > c.maxEntrySize() {
+		return &FileError{c.dir, key, ErrTooLarge}
+	}
+	if err := c.validate(key, old.Path, n, n); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(old.Path, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = f.Write(extra)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.Remove(old.Path) // The entry is already gone from the cache, and the file may be partially written.
+		return &FileError{c.dir, key, err}
+	}
+
+	m := c.addMeta(key, old.Path, n, n)
+	if old.Checksum != 0 || old.Size == 0 {
+		m.Checksum = crc32.Update(old.Checksum, crc32.IEEETable, extra)
 	}
-	listElement := c.list.PushFront(item)
-	c.m[key] = listElement
+	m.Expires = old.Expires
+	c.countPut(n)
+	return c.restoreHeader(m, old.Header)
+}
+
+// PutFile adds the contents of a file path as a blog to the cache. The source file will be moved or deleted once the blob is in the cache, and left in place if it is rejected.
+func (c *Cache) PutFile(key, srcpath string) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if err := c.checkWriteOnce(key); err != nil {
+		return err
+	}
+
+	n, err := filesize(srcpath)
+	if err != nil {
+		return err
+	}
+	compress := c.compresses(n)
+	if !compress && n > c.maxEntrySize() {
+		return c.reject(key, &FileError{c.dir, key, ErrTooLarge}) // Reject the file before it is moved, so that it stays where it is.
+	}
+	name, err := c.filename(key)
+	if err != nil {
+		return err
+	}
+	if c.useNames() {
+		if err := appendName(c.dir, name, key, c.filePerm()); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(c.dir, name)
+	length := n
+	var sum uint32
+	if compress {
+		r, err := os.Open(srcpath)
+		if err != nil {
+			return err
+		}
+		h := crc32.NewIEEE()
+		path, n, length, err = c.writeFile(name, io.TeeReader(r, h), c.codec, c.maxEntrySize())
+		r.Close()
+		if err != nil {
+			return c.reject(key, err)
+		}
+		sum = h.Sum32()
+		if err := c.validate(key, path, n, length); err != nil {
+			return err
+		}
+		os.Remove(srcpath)
+	} else {
+		if c.verify {
+			sum, err = checksumFile(srcpath)
+			if err != nil {
+				return err
+			}
+		}
+		if err := c.validate(key, path, n, length); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), c.dirPerm()); err != nil {
+			return &FileError{c.dir, key, err}
+		}
+		err = os.Rename(srcpath, path)
+		if err != nil {
+			return err
+		}
+		if c.fileMode != 0 {
+			os.Chmod(path, c.fileMode) // Best effort; the blob is in place either way.
+		}
+	}
+	m := c.addMeta(key, path, n, length)
+	m.Checksum = sum
+	m.Compressed = compress
+	c.countPut(n)
+	return nil
+}
+
+// SetFallbacks sets the sources that Get consults, in order, when a blob is missing from the cache or corrupt. The first fallback to succeed wins; its bytes are stored back into the cache as the most recently used entry and returned to the caller. Storing is best effort: a blob the cache cannot hold, e.g. one larger than the cache itself, is still returned.
+func (c *Cache) SetFallbacks(fallbacks ...Fallback) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.fallbacks = fallbacks
+}
+
+// Get returns a reader for a blob in the cache, or ErrNotFound otherwise. An entry whose file has disappeared from disk is dropped and reported as not found. The reader remains usable if the entry is evicted before it is closed.
+func (c *Cache) Get(key string) (io.ReadCloser, error) {
+	r, _, err := c.get(key, true)
+	if err == ErrNotFound || err == ErrCorrupt {
+		return c.getFallback(key, err)
+	}
+	return r, err
+}
+
+// GetContext is like Get, but reading from the returned reader fails with the error of ctx once ctx is done.
+func (c *Cache) GetContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &contextReadCloser{contextReader{ctx, r}, r}, nil
+}
+
+// Peek returns a reader for a blob in the cache, or ErrNotFound otherwise. Unlike Get, it does not affect the recency of the entry, count towards Stats, or consult fallbacks, which suits maintenance tasks such as integrity scans.
+func (c *Cache) Peek(key string) (io.ReadCloser, error) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	item, ok := c.m[escape(key)]
+	if !ok || item.Value.(*Meta).expired() {
+		return nil, ErrNotFound
+	}
+	r, err := c.open(item.Value.(*Meta))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// GetOrLoad returns a reader for a blob in the cache. On a miss, including a blob found corrupt with WithVerify, it calls loader, stores the result in the cache and returns a reader for it. Concurrent misses for the same key share a single call to loader. As with fallbacks, storing is best effort; an error is returned only if loader fails, and the failure is not cached.
+func (c *Cache) GetOrLoad(key string, loader func() ([]byte, error)) (io.ReadCloser, error) {
+	r, err := c.Get(key)
+	if err != ErrNotFound && err != ErrCorrupt { // A corrupt entry is gone by now, so it is a miss like any other.
+		return r, err
+	}
+
+	b, err := c.loads.do(escape(key), func() ([]byte, error) {
+		b, err := loader()
+		if err != nil {
+			return nil, err
+		}
+		c.Put(key, b) // Best effort, see SetFallbacks.
+		return b, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// GetReader returns a reader for a blob in the cache along with a copy of its meta information, or ErrNotFound otherwise, taking the lock only once. Unless promote is set, the recency of the entry is left alone. Unlike Get, it does not consult fallbacks.
+func (c *Cache) GetReader(key string, promote bool) (io.ReadCloser, Meta, error) {
+	return c.get(key, promote)
+}
+
+// GetRange returns a reader for length bytes of a blob in the cache starting at off, or ErrNotFound if there is none. A negative length reads to the end of the blob, and ranges past the end are cut short. Uncompressed blobs on disk are read from off directly; compressed ones have to be decompressed from the start, so reaching off costs as much as reading the bytes before it.
+func (c *Cache) GetRange(key string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, ErrBadRange
+	}
+	r, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := r.(io.Seeker); ok {
+		_, err = f.Seek(off, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, r, off)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		r.Close()
+		return nil, &FileError{c.dir, key, err}
+	}
+	if length < 0 {
+		return r, nil
+	}
+	return &readCloser{io.LimitReader(r, length), r}, nil
+}
+
+// ReadAtCloser is the interface that groups the ReadAt and Close methods.
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// GetReaderAt returns the blob of the given key for random access, along with its size, or ErrNotFound if there is none. The blob is read from its file on disk as needed, so it must be closed once done with. Compressed blobs cannot be accessed at random, so for them GetReaderAt fails with ErrNoRandomAccess.
+func (c *Cache) GetReaderAt(key string) (ReadAtCloser, int64, error) {
+	r, m, err := c.get(key, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	if m.Compressed {
+		r.Close()
+		return nil, 0, ErrNoRandomAccess
+	}
+	if f, ok := r.(*trackedFile); ok {
+		s, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, &FileError{c.dir, key, err}
+		}
+		return f, s.Size(), nil
+	}
+
+	// Served from memory.
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, 0, &FileError{c.dir, key, err}
+	}
+	return readAtCloser{bytes.NewReader(b)}, int64(len(b)), nil
+}
+
+// GetBytes returns the contents of a blob in the cache, or ErrNotFound otherwise.
+func (c *Cache) GetBytes(key string) ([]byte, error) {
+	r, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &FileError{c.dir, key, err}
+	}
+	return b, nil
+}
+
+// WriteTo copies the blob of the given key, decompressed, to w, and returns the number of bytes written, or ErrNotFound if there is none. Unlike with Get, there is no reader to close: the file is closed before WriteTo returns.
+func (c *Cache) WriteTo(key string, w io.Writer) (int64, error) {
+	r, err := c.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return io.Copy(w, r)
+}
+
+// GetString returns the contents of a blob in the cache as a string, or ErrNotFound otherwise.
+func (c *Cache) GetString(key string) (string, error) {
+	b, err := c.GetBytes(key)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// GetJSON unmarshals the contents of a blob in the cache into v, as json.Unmarshal does, or returns ErrNotFound if there is none.
+func (c *Cache) GetJSON(key string, v interface{}) error {
+	b, err := c.GetBytes(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// GetFile copies the blob of the given key, decompressed, to the file at dstpath, or returns ErrNotFound if there is none. The copy is written to a temporary file next to dstpath and renamed into place, so dstpath never holds a partial blob.
+func (c *Cache) GetFile(key, dstpath string) error {
+	r, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(dstpath), "."+filepath.Base(dstpath)+".")
+	if err != nil {
+		return &FileError{c.dir, key, err}
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dstpath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return &FileError{c.dir, key, err}
+	}
+	return nil
+}
+
+// get returns a reader for a blob in the cache along with a copy of its meta information, promoting the entry if asked to. Only locating and promoting the entry happen under the lock; opening its file, and checking it with WithVerify, happen without. Should the blob be replaced in between, the reader may return the new blob.
+func (c *Cache) get(key string, promote bool) (io.ReadCloser, Meta, error) {
+	defer c.notifyEvicted()
+
+	r, m, err := c.getOnce(key, promote)
+	if err == errStale {
+		// The entry changed while its file was being opened, e.g. by Rename; look it up afresh.
+		r, m, err = c.getOnce(key, promote)
+	}
+	if err == errStale {
+		c.countMiss()
+		return nil, Meta{}, ErrNotFound
+	}
+	return r, m, err
+}
+
+// getOnce is get without the retry: it fails with errStale if the entry changed between looking it up and opening its file, as the file opened may then not be the one described by the meta information.
+func (c *Cache) getOnce(key string, promote bool) (io.ReadCloser, Meta, error) {
+	item, m, b, err := c.locate(key, promote)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	if b != nil {
+		c.countHit()
+		return ioutil.NopCloser(bytes.NewReader(b)), m, nil
+	}
+
+	var r io.ReadCloser
+	if c.verify {
+		err = c.check(&m)
+	}
+	if err == nil {
+		r, err = c.open(&m)
+	}
+	if err == nil && !c.current(item, m.Path) {
+		r.Close()
+		return nil, Meta{}, errStale
+	}
+	if err == nil && c.mem != nil && (m.Compressed || m.Size <= c.mem.size) { // Compressed blobs may still fit.
+		r, err = c.hold(key, item, m.Path, r)
+	}
+	if os.IsNotExist(err) || err == ErrCorrupt {
+		return nil, Meta{}, c.prune(item, m.Path, err)
+	}
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	c.countHit()
+	return r, m, nil
+}
+
+// locate finds the entry of the given key, removing it if expired, and promotes it if asked to. It returns the entry along with a copy of its meta information, and the blob itself if held by the memory tier.
+func (c *Cache) locate(key string, promote bool) (*list.Element, Meta, []byte, error) {
+	c.l.Lock() // Promoting the entry mutates the list, so a read lock is not enough.
+	defer c.l.Unlock()
+
+	if c.closed {
+		return nil, Meta{}, nil, ErrClosed
+	}
+
+	item, ok := c.m[escape(key)]
+	if !ok {
+		c.countMiss()
+		return nil, Meta{}, nil, ErrNotFound
+	}
+	m := item.Value.(*Meta)
+	if m.expired() {
+		if err := c.remove(item); err != nil {
+			return nil, Meta{}, nil, err
+		}
+		c.logf("stash: removed %q: expired", m.Key)
+		c.countMiss()
+		return nil, Meta{}, nil, ErrNotFound
+	}
+
+	b, _ := c.memGet(m.Key)
+	if promote {
+		c.policy.Touch(c.list, item)
+		m.LastAccess = time.Now()
+	}
+	return item, copyMeta(m), b, nil
+}
+
+// prune forgets the entry of item, whose file at path was found gone or corrupt, and counts the failure as a miss. If the entry has been removed, replaced or moved to another path since, or its file turns out to be fine when looked at again with the lock held, it is left alone and errStale returned instead, as the failure may be down to a change made meanwhile, e.g. by Rename or CompactLayout.
+func (c *Cache) prune(item *list.Element, path string, err error) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if !c.isCurrent(item, path) {
+		return errStale
+	}
+	m := item.Value.(*Meta)
+	if err == ErrCorrupt {
+		err = c.check(m)
+	} else {
+		_, err = os.Stat(path)
+	}
+	if err != ErrCorrupt && !os.IsNotExist(err) {
+		return errStale
+	}
+
+	c.countMiss()
+	if err == ErrCorrupt {
+		c.remove(item)
+		c.logf("stash: removed %q: corrupt", m.Key)
+		return err
+	}
+	// The file was removed behind the cache's back.
+	c.drop(item)
+	c.logf("stash: dropped %q: file is gone", m.Key)
+	return ErrNotFound
+}
+
+// current reports whether item is still in the cache with its file at path, taking the read lock.
+func (c *Cache) current(item *list.Element, path string) bool {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	return c.isCurrent(item, path)
+}
+
+// isCurrent is current for callers holding the lock.
+func (c *Cache) isCurrent(item *list.Element, path string) bool {
+	m := item.Value.(*Meta)
+	return c.m[escape(m.Key)] == item && m.Path == path
+}
+
+// memGet returns the blob of the given key from the memory tier, if enabled and holding it.
+func (c *Cache) memGet(key string) ([]byte, bool) {
+	if c.mem == nil {
+		return nil, false
+	}
+	return c.mem.get(key)
+}
+
+// hold reads the blob of the entry of item from r into the memory tier and returns a reader for the copy in memory. If the blob turns out to be too large for the memory tier, it returns a reader for the rest of r instead. The blob is read without the lock, and left out of the memory tier if the entry has been replaced meanwhile.
+func (c *Cache) hold(key string, item *list.Element, path string, r io.ReadCloser) (io.ReadCloser, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, c.mem.size+1))
+	if err != nil {
+		r.Close()
+		return nil, &FileError{c.dir, key, err}
+	}
+	if int64(len(b)) > c.mem.size {
+		return &readCloser{io.MultiReader(bytes.NewReader(b), r), r}, nil
+	}
+	r.Close()
+
+	c.l.Lock()
+	if c.isCurrent(item, path) && item.Value.(*Meta).Key == key {
+		c.mem.add(key, b)
+	}
+	c.l.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// getFallback tries each fallback in order and repopulates the cache from the first one that succeeds. If none does, err is returned.
+func (c *Cache) getFallback(key string, err error) (io.ReadCloser, error) {
+	c.l.RLock()
+	fallbacks := c.fallbacks
+	c.l.RUnlock()
+
+	for _, f := range fallbacks {
+		r, ferr := f(key)
+		if ferr != nil {
+			continue
+		}
+		b, ferr := ioutil.ReadAll(r)
+		r.Close()
+		if ferr != nil {
+			continue
+		}
+
+		c.l.Lock()
+		c.putReader(key, bytes.NewReader(b), false) // Best effort, see SetFallbacks.
+		c.l.Unlock()
+		c.notifyEvicted()
+
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	return nil, err
+}
+
+// Increment adds delta to the integer counter stored against the given key and returns the new value. A missing or expired key counts as zero. The read and the write happen under a single lock, so concurrent increments are never lost. The counter stays ephemeral if it was put by PutEphemeral, and keeps its header and expiry.
+func (c *Cache) Increment(key string, delta int64) (int64, error) {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	var n int64
+	var old Meta
+	if item, ok := c.m[escape(key)]; ok && !item.Value.(*Meta).expired() {
+		old = *item.Value.(*Meta)
+		r, err := c.open(&old)
+		if err != nil {
+			return 0, err
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return 0, &FileError{c.dir, key, err}
+		}
+		n, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return 0, &FileError{c.dir, key, err}
+		}
+	}
+
+	n += delta
+	ephemeral := isEphemeral(filepath.Base(old.Path))
+	if err := c.putReader(key, strings.NewReader(strconv.FormatInt(n, 10)), ephemeral); err != nil {
+		return 0, err
+	}
+	m := c.m[escape(key)].Value.(*Meta)
+	m.Expires = old.Expires
+	if err := c.restoreHeader(m, old.Header); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Delete removes a blob from the cache, or returns ErrNotFound if there is none against the given key. An entry whose file is already gone from disk is dropped all the same.
+func (c *Cache) Delete(key string) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	item, ok := c.m[escape(key)]
+	if !ok {
+		return ErrNotFound
+	}
+	err := c.remove(item)
+	if os.IsNotExist(err) {
+		c.drop(item) // Nothing left to remove, e.g. an entry reported by Verify.
+		return nil
+	}
+	if err != nil {
+		return &FileError{c.dir, key, err}
+	}
+	return nil
+}
+
+// Rename moves the blob of oldKey to newKey, keeping its place in the eviction order and its meta information. It returns ErrNotFound if there is no blob against oldKey. A blob already against newKey is overwritten, which does not count as an eviction, unless the cache is write-once, in which case ErrAlreadyExists is returned.
+func (c *Cache) Rename(oldKey, newKey string) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	item, ok := c.m[escape(oldKey)]
+	if !ok {
+		return ErrNotFound
+	}
+	if escape(oldKey) == escape(newKey) {
+		return nil
+	}
+	if err := c.checkWriteOnce(newKey); err != nil {
+		return err
+	}
+
+	m := item.Value.(*Meta)
+	name, err := c.filename(newKey)
+	if err != nil {
+		return err
+	}
+	if isEphemeral(filepath.Base(m.Path)) {
+		name = ephemeralName(name)
+	} else if c.useNames() {
+		if err := appendName(c.dir, name, newKey, c.filePerm()); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(c.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), c.dirPerm()); err != nil {
+		return &FileError{c.dir, newKey, err}
+	}
+	if err := os.Rename(m.Path, path); err != nil {
+		return &FileError{c.dir, oldKey, err}
+	}
+	if other, ok := c.m[escape(newKey)]; ok {
+		o := other.Value.(*Meta)
+		if o.Path != path {
+			os.Remove(o.Path) // The overwritten blob was stored under a different name, e.g. it was ephemeral.
+		}
+		if o.Header != nil {
+			os.Remove(headerPath(o.Path))
+		}
+		c.drop(other)
+	}
+
+	delete(c.m, escape(oldKey))
+	if c.mem != nil {
+		c.mem.remove(oldKey)
+	}
+	oldPath := m.Path
+	m.Key = newKey
+	m.Path = path
+	c.m[escape(newKey)] = item
+	delete(c.files, oldPath)
+	c.files[path] = newKey
+
+	if m.Header != nil {
+		if err := os.Rename(headerPath(oldPath), headerPath(path)); err != nil {
+			return writeHeader(path, m.Header, c.filePerm())
+		}
+	}
+	return nil
+}
+
+// Verify checks every entry in the cache against its file on disk, and returns copies of those whose file is missing or does not have the recorded size, e.g. after tampering or a crash. It changes nothing; to prune the entries reported, pass their keys to Delete, or use Audit. If the totals of the cache do not add up to its entries, e.g. after the size of an entry was mis-recorded, the entries are returned along with ErrBadAccounting.
+func (c *Cache) Verify() ([]Meta, error) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	bad, err := c.inconsistent()
+	if err != nil {
+		return nil, err
+	}
+	return bad, c.checkTotals()
+}
+
+// Audit checks the cache against the storage directory both ways: it returns copies of the entries Verify would, along with the orphans, the names of the files in the storage directory that no entry tracks, e.g. left behind by a crash or put there behind the cache's back. With prune set, it removes the entries reported, deleting what is left of their files, and deletes the orphans too. Files of other caches sharing the storage directory count as orphans; so do files Warmup would adopt.
+func (c *Cache) Audit(prune bool) (bad []Meta, orphans []string, err error) {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return nil, nil, ErrClosed
+	}
+
+	bad, err = c.inconsistent()
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := listFiles(c.dir, c.keyToPath != nil, c.warmupWorkers)
+	if err != nil {
+		return nil, nil, &FileError{c.dir, "", err}
+	}
+	for _, file := range files {
+		if _, ok := c.files[filepath.Join(c.dir, file.name)]; !ok {
+			orphans = append(orphans, file.name)
+		}
+	}
+	sort.Strings(orphans)
+	if !prune {
+		return bad, orphans, nil
+	}
+
+	for _, m := range bad {
+		if err := c.remove(c.m[escape(m.Key)]); err != nil {
+			return nil, nil, &FileError{c.dir, m.Key, err}
+		}
+		c.logf("stash: removed %q: file missing or of the wrong size", m.Key)
+	}
+	for _, name := range orphans {
+		path := filepath.Join(c.dir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, nil, &FileError{c.dir, name, err}
+		}
+		os.Remove(headerPath(path))
+		c.logf("stash: removed %s: not tracked by the cache", name)
+	}
+	return bad, orphans, nil
+}
+
+// checkTotals returns ErrBadAccounting if the totals of the cache do not add up to its entries. The caller must hold the lock.
+func (c *Cache) checkTotals() error {
+	var size, length, n int64
+	for item := c.list.Front(); item != nil; item = item.Next() {
+		m := item.Value.(*Meta)
+		size += m.Size
+		length += m.Length
+		n++
+	}
+	if size != c.sizeUsed || length != c.lengthUsed || n != c.capUsed {
+		return ErrBadAccounting
+	}
+	return nil
+}
+
+// inconsistent does the checks of Verify on the entries. The caller must hold the lock.
+func (c *Cache) inconsistent() ([]Meta, error) {
+	var bad []Meta
+	for item := c.list.Front(); item != nil; item = item.Next() {
+		m := item.Value.(*Meta)
+		s, err := os.Stat(m.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, &FileError{c.dir, m.Key, err}
+		}
+		if err != nil || s.Size() != m.Size {
+			bad = append(bad, copyMeta(m))
+		}
+	}
+	return bad, nil
+}
+
+// Touch promotes the blob of the given key as Get does, without opening its file, or returns ErrNotFound if there is none. It protects a blob about to be needed from eviction at little cost.
+func (c *Cache) Touch(key string) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	item, ok := c.m[escape(key)]
+	if !ok || item.Value.(*Meta).expired() {
+		return ErrNotFound
+	}
+	c.policy.Touch(c.list, item)
+	item.Value.(*Meta).LastAccess = time.Now()
+	return nil
+}
+
+// Has reports whether the cache holds a blob against the given key that has not expired. Unlike Get, it does not affect the recency of the entry.
+func (c *Cache) Has(key string) bool {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	item, ok := c.m[escape(key)]
+	return ok && !item.Value.(*Meta).expired()
+}
+
+// Stat returns a copy of the meta information of a blob in the cache, or ErrNotFound if there is none or it has expired. It does not affect the recency of the entry.
+func (c *Cache) Stat(key string) (Meta, error) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	if c.closed {
+		return Meta{}, ErrClosed
+	}
+
+	item, ok := c.m[escape(key)]
+	if !ok || item.Value.(*Meta).expired() {
+		return Meta{}, ErrNotFound
+	}
+	return copyMeta(item.Value.(*Meta)), nil
+}
+
+// Dir returns the path to the storage directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Deflate reports whether the cache compresses blobs, by WithDeflate or WithCodec. Blobs may still be stored uncompressed, e.g. below WithDeflateMinSize or from an earlier run without compression: Stat reports whether a given one is in Meta.Compressed.
+func (c *Cache) Deflate() bool {
+	return c.codec != nil
+}
+
+// MaxSize returns the total size of the blobs the cache allows.
+func (c *Cache) MaxSize() int64 {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	return c.size
+}
+
+// MaxEntries returns the number of blobs the cache allows.
+func (c *Cache) MaxEntries() int64 {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	return c.cap
+}
+
+// Size returns the total size of the blobs in the cache, including expired ones not removed yet.
+func (c *Cache) Size() int64 {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	return c.sizeUsed
+}
+
+// Len returns the number of blobs in the cache, including expired ones not removed yet.
+func (c *Cache) Len() int64 {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	return c.capUsed
+}
+
+// Range calls f for each entry in the cache, from the last to the first to be evicted (under LRU, from the most to the least recently used), until f returns false. The read lock is held throughout, so f must not modify the cache.
+func (c *Cache) Range(f func(m Meta) bool) error {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	for item := c.list.Front(); item != nil; item = item.Next() {
+		if !f(copyMeta(item.Value.(*Meta))) {
+			break
+		}
+	}
+	return nil
+}
+
+// Keys returns a list of keys in the cache, leaving out expired ones.
+func (c *Cache) Keys() []string {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	keys := make([]string, 0, c.list.Len())
+	for item := c.list.Back(); item != nil; item = item.Prev() {
+		if m := item.Value.(*Meta); !m.expired() {
+			keys = append(keys, m.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// KeysWithPrefix returns a sorted list of the keys in the cache that start with the given prefix, e.g. "images/", leaving out expired ones. Keys are matched as given, not as escaped into file names.
+func (c *Cache) KeysWithPrefix(prefix string) []string {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	keys := []string{}
+	for item := c.list.Back(); item != nil; item = item.Prev() {
+		if m := item.Value.(*Meta); strings.HasPrefix(m.Key, prefix) && !m.expired() {
+			keys = append(keys, m.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// KeysByRecency returns a list of keys in the cache, from the entry to be evicted last to the one to be evicted first, leaving out expired ones. With LRU, that is from the most to the least recently used.
+func (c *Cache) KeysByRecency() []string {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	keys := make([]string, 0, c.list.Len())
+	for item := c.list.Front(); item != nil; item = item.Next() {
+		if m := item.Value.(*Meta); !m.expired() {
+			keys = append(keys, m.Key)
+		}
+	}
+	return keys
+}
+
+// open returns a reader for the file of an entry, decompressing it if compressed. The file counts as open until the reader is closed.
+func (c *Cache) open(m *Meta) (io.ReadCloser, error) {
+	f, err := os.Open(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	tf := c.track(f)
+	if m.Compressed {
+		codec := c.codec
+		if codec == nil {
+			codec = LZ4 // Compressed by an earlier run, with compression since turned off.
+		}
+		return newCodecReader(codec, tf)
+	}
+	return tf, nil
+}
+
+// compresses reports whether a blob of n bytes is to be compressed.
+func (c *Cache) compresses(n int64) bool {
+	return c.codec != nil && n >= c.minDeflate
+}
+
+// compressor decides whether the blob read from r is to be compressed, reading ahead as far as WithDeflateMinSize requires. It returns the codec to compress it with, nil if none, along with a reader for the whole blob.
+func (c *Cache) compressor(r io.Reader) (Codec, io.Reader, error) {
+	if c.codec == nil || c.minDeflate <= 0 {
+		return c.codec, r, nil
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(r, c.minDeflate))
+	if err != nil {
+		return nil, nil, err
+	}
+	r = io.MultiReader(bytes.NewReader(head), r)
+	if !c.compresses(int64(len(head))) {
+		return nil, r, nil
+	}
+	return c.codec, r, nil
+}
+
+// Clear removes every blob from the cache. It attempts to remove all files even if some fail, and returns the first error encountered. The cache is empty afterwards either way.
+func (c *Cache) Clear() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	var err error
+	for item := c.list.Front(); item != nil; item = item.Next() {
+		m := item.Value.(*Meta)
+		if e := os.Remove(m.Path); e != nil && !os.IsNotExist(e) && !c.deferUnlink(m.Path) && err == nil {
+			err = &FileError{c.dir, m.Key, e}
+		}
+		if m.Header != nil {
+			os.Remove(headerPath(m.Path))
+		}
+	}
+
+	c.list = list.New()
+	c.m = make(map[string]*list.Element)
+	c.files = make(map[string]string)
+	atomic.StoreInt64(&c.sizeUsed, 0)
+	atomic.StoreInt64(&c.lengthUsed, 0)
+	c.capUsed = 0
+	if c.mem != nil {
+		c.mem.clear()
+	}
+
+	return err
+}
+
+// CompactLayout rebuilds the storage directory from scratch, carrying over only the files of entries in the cache, those of writers returned by PutWriter and not closed yet, and the directories of namespaces. Directories of long-running caches accumulate debris from deleted files, which slows down scans such as Warmup; a fresh directory does not. Recency order and metadata of the entries are preserved. Readers returned by Get before the call remain usable where the operating system allows renaming directories with open files. The new directory replaces the old one by two renames, not atomically; should the process crash in between, the storage directory is missing, and New puts the new directory in its place.
+func (c *Cache) CompactLayout() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	s, err := os.Stat(c.dir)
+	if err != nil {
+		return &FileError{c.dir, "", err}
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(c.dir), compactPrefix(c.dir))
+	if err != nil {
+		return &FileError{c.dir, "", err}
+	}
+	defer os.RemoveAll(tmp) // Nothing left to remove after a successful swap.
+
+	names := map[string]string{}
+	for item := c.list.Back(); item != nil; item = item.Prev() {
+		m := item.Value.(*Meta)
+		name, err := filepath.Rel(c.dir, m.Path)
+		if err != nil {
+			return &FileError{c.dir, m.Key, err}
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, name)), c.dirPerm()); err != nil {
+			return &FileError{c.dir, m.Key, err}
+		}
+		if err := linkOrCopy(m.Path, filepath.Join(tmp, name)); err != nil {
+			return &FileError{c.dir, m.Key, err}
+		}
+		if m.Header != nil {
+			if err := linkOrCopy(headerPath(m.Path), headerPath(filepath.Join(tmp, name))); err != nil {
+				return &FileError{c.dir, m.Key, err}
+			}
+		}
+		names[name] = m.Key
+	}
+	if c.useNames() {
+		if err := writeNames(tmp, names, c.filePerm()); err != nil {
+			return err
+		}
+	}
+	for w := range c.writers {
+		// Link rather than copy, so that what is written after the swap still ends up in the file.
+		if name := w.f.Name(); filepath.Dir(name) == filepath.Clean(c.dir) {
+			if err := os.Link(name, filepath.Join(tmp, filepath.Base(name))); err != nil {
+				return &FileError{c.dir, w.key, err}
+			}
+		}
+	}
+	if err := moveReserved(c.dir, tmp); err != nil {
+		return &FileError{c.dir, "", err}
+	}
+	if err := os.Chmod(tmp, s.Mode().Perm()); err != nil {
+		return &FileError{c.dir, "", err}
+	}
+	if err := swapDir(c.dir, tmp); err != nil {
+		return &FileError{c.dir, "", err}
+	}
+	return nil
+}
+
+// Namespace returns a cache for the given namespace, isolated from the keys of c and of other namespaces. It lives in a subdirectory of the storage directory, and is created with the same options as c. Each namespace has limits of its own: blobs in one never evict blobs in another or in c. Calling Namespace again with the same name returns the same cache, and closing c closes its namespaces.
+func (c *Cache) Namespace(name string) (*Cache, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if ns, ok := c.namespaces[name]; ok {
+		return ns, nil
+	}
+
+	dir := filepath.Join(c.dir, namespacePrefix+escape(name))
+	if err := os.MkdirAll(dir, c.dirPerm()); err != nil {
+		return nil, &FileError{c.dir, name, err}
+	}
+	ns, err := New(dir, c.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.namespaces == nil {
+		c.namespaces = make(map[string]*Cache)
+	}
+	c.namespaces[name] = ns
+	return ns, nil
+}
+
+// filename returns the path, relative to the storage directory, to the file that holds the blob of the given key. It returns ErrBadKey if the file would not be inside the storage directory, and ErrKeyCollision if the file, or its ephemeral counterpart, holds the blob of another key, e.g. as WithKeyToPath mapped both keys to the same path.
+func (c *Cache) filename(key string) (string, error) {
+	name := escape(key)
+	if c.hashNames {
+		name = hashName(key)
+	}
+	if c.keyToPath != nil {
+		name = filepath.FromSlash(c.keyToPath(name))
+	}
+	if !safeName(name) {
+		return "", ErrBadKey
+	}
+	for _, n := range []string{name, ephemeralName(name)} {
+		if other, ok := c.files[filepath.Join(c.dir, n)]; ok && other != key {
+			return "", ErrKeyCollision
+		}
+	}
+	return name, nil
+}
+
+// useNames reports whether the keys of blobs must be recorded in the names file, as they cannot be told from the paths to their files.
+func (c *Cache) useNames() bool {
+	return c.hashNames || c.keyToPath != nil
+}
+
+// checkWriteOnce returns ErrAlreadyExists if the cache is write-once and already holds the key.
+func (c *Cache) checkWriteOnce(key string) error {
+	if _, ok := c.m[escape(key)]; ok && c.writeOnce {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+// check reads the blob of an entry in full and returns ErrCorrupt if it cannot be read back or does not match its checksum. Entries without a checksum pass.
+func (c *Cache) check(m *Meta) error {
+	if m.Checksum == 0 {
+		return nil
+	}
+	r, err := c.open(m)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, r); err != nil || h.Sum32() != m.Checksum {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// Resize changes the total size and number of files the cache allows, evicting entries right away until the cache fits. It returns the number of entries evicted.
+func (c *Cache) Resize(size, cap int64) (int, error) {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if size <= 0 {
+		return 0, ErrBadSize
+	}
+	if cap <= 0 {
+		return 0, ErrBadCap
+	}
+
+	c.size = size
+	c.cap = cap
+
+	return c.evictDown(c.size, c.cap, 0, 0)
+}
+
+// TrimToSize evicts entries following the eviction policy until the blobs in the cache take up at most target bytes, leaving the configured limits alone. It returns the number of entries evicted.
+func (c *Cache) TrimToSize(target int64) (int, error) {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	return c.evictDown(target, c.capUsed, 0, 0)
+}
+
+// WouldEvict reports how many entries adding a blob of the given size would evict, without evicting anything. It returns -1 if the blob is too large for the cache and would be rejected.
+func (c *Cache) WouldEvict(size int64) int {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	if size > c.maxEntrySize() {
+		return -1
+	}
+	return len(evictionPlan(c.list, c.sizeOf, c.used(), c.capUsed, c.size, c.cap, size, 1))
+}
+
+// EvictionPlan returns the keys of the entries that adding a blob of the given size would evict, in the order they would be evicted, without evicting anything.
+func (c *Cache) EvictionPlan(size int64) []string {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	return evictionPlan(c.list, c.sizeOf, c.used(), c.capUsed, c.size, c.cap, size, 1)
+}
+
+// evictDown evicts entries as planned by evictionPlan until a blob of n bytes, as counted by sizeOf, and the given number of entries fit within size and cap, and returns how many it evicted. An entry whose file cannot be removed is marked stuck, which evictionPlan skips, and the rest evicted as planned before planning again past it, so that a single stuck file does not jam the cache. The failure is logged, and the stuck entries are returned in an EvictError if the blob does not fit without them. Entries stay marked until the next call, which tries them again, so that a passing failure does not pin an entry for good.
+func (c *Cache) evictDown(size, cap, n, entries int64) (int, error) {
+	for _, m := range c.stuck {
+		m.stuck = nil
+	}
+	c.stuck = c.stuck[:0]
+
+	evicted := 0
+	for {
+		keys := evictionPlan(c.list, c.sizeOf, c.used(), c.capUsed, size, cap, n, entries)
+		skipped := false
+		for _, key := range keys {
+			if c.evictOrSkip(c.m[escape(key)]) {
+				evicted++
+			} else {
+				skipped = true
+			}
+		}
+		if !skipped {
+			break
+		}
+	}
+
+	if c.used()+n <= size && c.capUsed+entries <= cap {
+		return evicted, nil
+	}
+	if len(c.stuck) > 0 {
+		errs := make(map[string]error, len(c.stuck))
+		for _, m := range c.stuck {
+			errs[m.Key] = m.stuck
+		}
+		return evicted, &EvictError{errs}
+	}
+	return evicted, nil
+}
+
+// evictOrSkip evicts the entry of item and reports whether it did. If its file cannot be removed, the entry is left in place and marked stuck.
+func (c *Cache) evictOrSkip(item *list.Element) bool {
+	err := c.evict(item)
+	if err == nil {
+		return true
+	}
+	m := item.Value.(*Meta)
+	c.logf("stash: skipped evicting %q: %v", m.Key, err)
+	m.stuck = err
+	c.stuck = append(c.stuck, m)
+	return false
+}
+
+// notifyEvicted passes the entries evicted so far to the OnEvict hook, and the lines logged so far to the logger. It must be called without holding the lock, so that the hook and the logger may use the cache.
+func (c *Cache) notifyEvicted() {
+	if c.onEvict == nil && c.logger == nil {
+		return
+	}
+
+	c.l.Lock()
+	evicted, logs := c.evicted, c.logs
+	c.evicted, c.logs = nil, nil
+	c.l.Unlock()
+
+	for _, line := range logs {
+		c.logger.Printf("%s", line)
+	}
+	if c.onEvict != nil {
+		for _, m := range evicted {
+			c.onEvict(m.Key, m.Size)
+		}
+	}
+}
+
+// sizeOf returns the size of an entry as counted against the limits of the cache.
+func (c *Cache) sizeOf(m *Meta) int64 {
+	if c.logical {
+		return m.Length
+	}
+	return m.Size
+}
+
+// used returns the total size of the entries as counted against the limits of the cache.
+func (c *Cache) used() int64 {
+	if c.logical {
+		return c.lengthUsed
+	}
+	return c.sizeUsed
+}
+
+// maxEntrySize returns the size of the largest blob the cache accepts.
+func (c *Cache) maxEntrySize() int64 {
+	if c.entrySize > 0 && c.entrySize < c.size {
+		return c.entrySize
+	}
+	return c.size
+}
+
+// validate ensures the file of the given key, of size n on disk and length before compression, satisfies the constraints of the cache, evicting other entries to make room for it. The file is removed if it does not.
+func (c *Cache) validate(key, path string, n, length int64) error {
+	// Forget the entry being replaced first, so it neither counts against the limits nor gets evicted, taking the new file with it.
+	if item, ok := c.m[escape(key)]; ok {
+		old := item.Value.(*Meta)
+		if old.Path != path {
+			os.Remove(old.Path)
+		}
+		if old.Header != nil {
+			os.Remove(headerPath(old.Path))
+		}
+		c.drop(item)
+	}
+
+	if c.logical {
+		n = length
+	}
+	err := c.makeRoom(key, n)
+	if err != nil {
+		os.Remove(path) // XXX(hjr265): We should not supress this error even if it is very unlikely.
+		return c.reject(key, err)
+	}
+	return nil
+}
+
+// makeRoom evicts entries until a blob of n bytes, as counted by sizeOf, fits in the cache.
+func (c *Cache) makeRoom(key string, n int64) error {
+	if n > c.maxEntrySize() {
+		return &FileError{c.dir, "", ErrTooLarge}
+	}
+
+	if _, err := c.evictDown(c.size, c.cap, n, 1); err != nil {
+		return err
+	}
+
+	for c.minFree > 0 {
+		free, err := freeSpace(c.dir)
+		if err != nil {
+			return &FileError{c.dir, key, err}
+		}
+		if free < 0 || free >= c.minFree {
+			break
+		}
+		if c.list.Len() == 0 {
+			return &FileError{c.dir, key, ErrNoSpace}
+		}
+		if _, err := c.evictLast(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// freeSpace returns the number of bytes available on the filesystem holding dir, or -1 if unknown.
+var freeSpace = statfsFree
+
+// evictLast evicts the last entry following the eviction policy, skipping stuck ones, and returns its size. It fails with an EvictError if there are entries but all are stuck.
+func (c *Cache) evictLast() (int64, error) {
+	used := c.sizeUsed
+	if _, err := c.evictDown(math.MaxInt64, c.capUsed-1, 0, 0); err != nil {
+		return 0, err
+	}
+	return used - c.sizeUsed, nil
+}
+
+// evict removes an entry, counting it as evicted.
+func (c *Cache) evict(element *list.Element) error {
+	if err := c.remove(element); err != nil {
+		return err
+	}
+	m := element.Value.(*Meta)
+	c.countEviction()
+	if c.onEvict != nil || c.collect {
+		c.evicted = append(c.evicted, *m)
+	}
+	c.logf("stash: evicted %q (%d bytes)", m.Key, m.Size)
+	return nil
+}
+
+// remove deletes the file of an entry, along with its header, and drops the entry from the cache. If the file cannot be deleted while readers have it open, as on Windows, deleting it is left to the last reader to close it.
+func (c *Cache) remove(element *list.Element) error {
+	item := element.Value.(*Meta)
+	if e := os.Remove(item.Path); e == nil || os.IsNotExist(e) || c.deferUnlink(item.Path) {
+		if item.Header != nil {
+			os.Remove(headerPath(item.Path))
+		}
+		c.drop(element)
+		return nil
+	} else {
+		return e
+	}
+}
+
+// restoreHeader saves h as the header of m again, after its blob was rewritten.
+func (c *Cache) restoreHeader(m *Meta, h map[string]string) error {
+	if h == nil {
+		return nil
+	}
+	if err := writeHeader(m.Path, h, c.filePerm()); err != nil {
+		return err
+	}
+	m.Header = h
+	return nil
+}
+
+// drop removes an entry from the cache, leaving its file alone. If subtracting the entry would take the totals of the cache below zero, revealing them to be wrong, they are set to zero instead and the drift is logged; Verify reports it with ErrBadAccounting.
+func (c *Cache) drop(element *list.Element) {
+	item := element.Value.(*Meta)
+	if c.mem != nil {
+		c.mem.remove(item.Key)
+	}
+	delete(c.m, escape(item.Key))
+	delete(c.files, item.Path)
+	removeElement(c.policy, c.list, element)
+
+	ok := true
+	size, length := c.sizeUsed-item.Size, c.lengthUsed-item.Length
+	c.capUsed--
+	if size < 0 {
+		size = 0
+		ok = false
+	}
+	if length < 0 {
+		length = 0
+		ok = false
+	}
+	atomic.StoreInt64(&c.sizeUsed, size)
+	atomic.StoreInt64(&c.lengthUsed, length)
+	if c.capUsed < 0 {
+		c.capUsed = 0
+		ok = false
+	}
+	if !ok {
+		c.logf("stash: size accounting went below zero dropping %q; reset to zero", item.Key)
+	}
+}
+
+// addMeta adds meta information to the cache and returns it. The key is the original, unescaped key.
+func (c *Cache) addMeta(key, path string, size, length int64) *Meta {
+	c.keepFile(path)
+	if item, ok := c.m[escape(key)]; ok {
+		old := item.Value.(*Meta)
+		if old.Path != path {
+			os.Remove(old.Path) // The entry moved to a different file, e.g. it became ephemeral.
+		}
+		c.drop(item)
+	}
+	atomic.AddInt64(&c.sizeUsed, size)
+	atomic.AddInt64(&c.lengthUsed, length)
+	c.capUsed++
+	c.files[path] = key
+
+	item := &Meta{
+		Key:        key,
+		Size:       size,
+		Length:     length,
+		Path:       path,
+		LastAccess: time.Now(),
+	}
+	listElement := c.policy.Add(c.list, item)
+	c.m[escape(key)] = listElement
+	return item
+}
+
+// checkDir recovers the storage directory from an interrupted CompactLayout, creates it if missing, and makes sure files can be written to it, so that New fails rather than the first Put.
+func (c *Cache) checkDir() error {
+	if err := recoverSwap(c.dir); err != nil {
+		return &FileError{c.dir, "", err}
+	}
+	if err := os.MkdirAll(c.dir, c.dirPerm()); err != nil {
+		return &FileError{c.dir, "", &badDirError{err}}
+	}
+	f, err := ioutil.TempFile(c.dir, tempPrefix+"probe.")
+	if err != nil {
+		return &FileError{c.dir, "", &badDirError{err}}
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return &FileError{c.dir, "", &badDirError{err}}
+	}
+	return nil
 }
 
 func validDir(dir string) bool {
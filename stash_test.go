@@ -2,12 +2,30 @@ package stash
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/pierrec/lz4"
 )
@@ -52,20 +70,48 @@ func TestNew(t *testing.T) {
 			c:   0,
 			err: ErrBadCap,
 		},
+		{
+			dir: storageDir,
+			sz:  2048,
+			c:   4,
+			err: nil,
+		},
 	} {
 		clearStorage()
 
-		_, err := New(c.dir, c.sz, c.c, false)
+		_, err := New(c.dir, WithMaxSize(c.sz), WithMaxEntries(c.c))
 		if err != c.err {
 			t.Fatalf("#%d: Expected err == %q, got %q", i+1, c.err, err)
 		}
 	}
 }
 
+func TestNewDir(t *testing.T) {
+	clearStorage()
+
+	dir := filepath.Join(storageDir, "missing", "dir")
+	_, err := New(dir, WithMaxSize(2048), WithMaxEntries(4))
+	catch(err)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		t.Fatalf("Expected %s to be created, got %v", dir, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected no probe file left, got %d file(s)", len(files))
+	}
+
+	file := filepath.Join(storageDir, "file")
+	err = ioutil.WriteFile(file, nil, 0666)
+	catch(err)
+	_, err = New(file, WithMaxSize(2048), WithMaxEntries(4))
+	if !errors.Is(err, ErrBadDir) {
+		t.Fatalf("Expected err == %q, got %q", ErrBadDir, err)
+	}
+}
+
 func TestCachePut(t *testing.T) {
 	clearStorage()
 
-	s, err := New(storageDir, 2048000, 40, false)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
 	for k, b := range blobs {
 		err := s.Put(k, b)
@@ -82,6 +128,30 @@ func TestCachePut(t *testing.T) {
 	}
 }
 
+func TestCachePutBatch(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(10), WithMaxEntries(40))
+	catch(err)
+	err = s.PutBatch(map[string][]byte{
+		"a": []byte("abc"),
+		"b": []byte("abcdefghijk"),
+		"c": []byte("def"),
+	})
+	berr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("Expected *BatchError, got %q", err)
+	}
+	if len(berr.Errs) != 1 || berr.Errs["b"] == nil {
+		t.Fatalf("Expected only b to fail, got %q", err)
+	}
+	assertKeys(t, s.Keys(), []string{"a", "c"})
+
+	err = s.PutBatch(map[string][]byte{"d": []byte("ghi")})
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "c", "d"})
+}
+
 func TestCachePutFile(t *testing.T) {
 	clearStorage()
 
@@ -89,7 +159,7 @@ func TestCachePutFile(t *testing.T) {
 	k := "fi/le"
 	b := []byte("abcdefgh")
 
-	s, err := New(storageDir, 2048000, 40, false)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
 	f, err := os.Create(filename)
 	catch(err)
@@ -109,7 +179,78 @@ func TestCachePutFile(t *testing.T) {
 }
 
 func TestCachePutFileDeflate(t *testing.T) {
-	//TODO:
+	clearStorage()
+
+	filename := "putfile"
+	k := "fi/le"
+	b := []byte("abcdefgh")
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true))
+	catch(err)
+	err = ioutil.WriteFile(filename, b, 0666)
+	catch(err)
+	defer os.Remove(filename)
+	err = s.PutFile(k, filename)
+	catch(err)
+
+	r, err := s.Get(k)
+	catch(err)
+	v, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, v) {
+		t.Fatalf("Expected v == %q, got %q", b, v)
+	}
+}
+
+func TestCacheSizeDeflate(t *testing.T) {
+	clearStorage()
+
+	value := bytes.Repeat([]byte("a"), 100000)
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true))
+	catch(err)
+	err = s.Put("key", value)
+	catch(err)
+
+	fi, err := os.Stat(filepath.Join(storageDir, "key"))
+	catch(err)
+	if n := s.Size(); n != fi.Size() {
+		t.Fatalf("Expected Size() == %d, got %d", fi.Size(), n)
+	}
+	if n := s.Size(); n >= int64(len(value))/10 {
+		t.Fatalf("Expected Size() < %d, got %d", len(value)/10, n)
+	}
+}
+
+func TestCachePutFileTooLarge(t *testing.T) {
+	filename := "putfile"
+	b := make([]byte, 64)
+	rand.Read(b) // Incompressible, so it is too large even when deflated.
+
+	for _, deflate := range []bool{false, true} {
+		for _, opt := range []Option{WithMaxSize(32), WithMaxEntrySize(32)} {
+			clearStorage()
+
+			s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(deflate), opt)
+			catch(err)
+			err = ioutil.WriteFile(filename, b, 0666)
+			catch(err)
+
+			err = s.PutFile("a", filename)
+			if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+				t.Fatalf("deflate=%v: Expected err == %q, got %q", deflate, ErrTooLarge, err)
+			}
+			v, err := ioutil.ReadFile(filename)
+			catch(err)
+			if !bytes.Equal(b, v) {
+				t.Fatalf("deflate=%v: Expected source to be left intact", deflate)
+			}
+			if _, err := os.Stat(filepath.Join(storageDir, "a")); !os.IsNotExist(err) {
+				t.Fatalf("deflate=%v: Expected no file in the cache, got %v", deflate, err)
+			}
+			os.Remove(filename)
+		}
+	}
 }
 
 func TestCachePutDeflate(t *testing.T) {
@@ -118,7 +259,7 @@ func TestCachePutDeflate(t *testing.T) {
 	key := "key"
 	value := []byte("value")
 
-	s, err := New(storageDir, 2048000, 40, true)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true))
 	catch(err)
 	s.Put(key, value)
 
@@ -140,7 +281,7 @@ func TestCacheGetDeflate(t *testing.T) {
 	key := "key"
 	value := []byte("value")
 
-	s, err := New(storageDir, 2048000, 40, true)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true))
 	catch(err)
 	s.Put(key, value)
 
@@ -159,10 +300,37 @@ func TestCacheGetDeflate(t *testing.T) {
 	}
 }
 
+func TestCacheCodec(t *testing.T) {
+	clearStorage()
+
+	key := "key"
+	value := []byte("value")
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithCodec(xorCodec{}))
+	catch(err)
+	err = s.Put(key, value)
+	catch(err)
+
+	raw, err := ioutil.ReadFile(filepath.Join(storageDir, key))
+	catch(err)
+	if bytes.Equal(raw, value) {
+		t.Fatalf("Expected blob to be encoded on disk, got %q", raw)
+	}
+
+	r, err := s.Get(key)
+	catch(err)
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	catch(err)
+	if !bytes.Equal(got, value) {
+		t.Fatalf("Expected v == %q, got %q", value, got)
+	}
+}
+
 func TestWarmup(t *testing.T) {
 	clearStorage()
 
-	s, err := New(storageDir, 2048000, 40, false)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
 	for k, b := range blobs {
 		path := filepath.Join(storageDir, escape(k))
@@ -170,7 +338,15 @@ func TestWarmup(t *testing.T) {
 		catch(err)
 	}
 
-	s.Warmup()
+	err = s.Warmup()
+	catch(err)
+
+	keys := []string{}
+	for k := range blobs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assertKeys(t, s.Keys(), keys)
 
 	for k, b := range blobs {
 		r, err := s.Get(k)
@@ -183,83 +359,3546 @@ func TestWarmup(t *testing.T) {
 	}
 }
 
-func TestSizeEviction(t *testing.T) {
+func TestCachePutReaderContext(t *testing.T) {
 	clearStorage()
 
-	s, err := New(storageDir, 10, 40, false)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
 
-	err = s.Put("a", []byte("abcdefgh"))
+	ctx, cancel := context.WithCancel(context.Background())
+	r := io.MultiReader(bytes.NewReader([]byte("abc")), readerFunc(func(p []byte) (int, error) {
+		cancel()
+		return copy(p, "def"), nil
+	}), bytes.NewReader([]byte("ghi")))
+	err = s.PutReaderContext(ctx, "a", r)
+	if err != context.Canceled {
+		t.Fatalf("Expected err == %q, got %q", context.Canceled, err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("Expected partial file to be removed, got %v", err)
+	}
+	assertKeys(t, s.Keys(), []string{})
+
+	err = s.Put("b", []byte("abc"))
 	catch(err)
-	err = s.Put("b", []byte("ij"))
+	ctx, cancel = context.WithCancel(context.Background())
+	rc, err := s.GetContext(ctx, "b")
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"a", "b"})
+	defer rc.Close()
+	cancel()
+	if _, err := ioutil.ReadAll(rc); err != context.Canceled {
+		t.Fatalf("Expected err == %q, got %q", context.Canceled, err)
+	}
+}
 
-	err = s.Put("c", []byte("k"))
+func TestCacheGetBytes(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true))
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"b", "c"})
+	for k, b := range blobs {
+		err := s.Put(k, b)
+		catch(err)
+	}
 
-	err = s.Put("d", []byte("l"))
+	for k, b := range blobs {
+		v, err := s.GetBytes(k)
+		catch(err)
+		if !bytes.Equal(b, v) {
+			t.Fatalf("Expected v == %q, got %q", b, v)
+		}
+	}
+
+	if _, err := s.GetBytes("missing"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+}
+
+func TestCacheGetMissingFile(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = os.Remove(filepath.Join(storageDir, "a"))
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"b", "c", "d"})
 
-	err = s.Put("e", []byte("m"))
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+	if s.Has("a") {
+		t.Fatalf("Expected Has(%q) == false", "a")
+	}
+	if n := s.Size(); n != 0 {
+		t.Fatalf("Expected Size() == 0, got %d", n)
+	}
+}
+
+func TestCacheGetVerify(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(deflate), WithVerify(true))
+		catch(err)
+		err = s.Put("a", []byte("abcdef"))
+		catch(err)
+		_, err = s.GetBytes("a")
+		catch(err)
+
+		// Overwrite the blob behind the cache's back, keeping the codec intact.
+		f, err := os.Create(filepath.Join(storageDir, "a"))
+		catch(err)
+		var w io.WriteCloser = f
+		if deflate {
+			w = lz4.NewWriter(f)
+		}
+		w.Write([]byte("abcdeX"))
+		w.Close()
+		f.Close()
+
+		if _, err := s.Get("a"); err != ErrCorrupt {
+			t.Fatalf("deflate=%v: Expected err == %q, got %q", deflate, ErrCorrupt, err)
+		}
+		if s.Has("a") {
+			t.Fatalf("deflate=%v: Expected corrupt entry to be removed", deflate)
+		}
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"b", "c", "d", "e"})
 
-	err = s.Put("f", []byte("nopqrstuvw"))
+	calls := 0
+	loader := func() ([]byte, error) {
+		calls++
+		return []byte("loaded"), nil
+	}
+	for i := 0; i < 2; i++ {
+		r, err := s.GetOrLoad("a", loader)
+		catch(err)
+		v, err := ioutil.ReadAll(r)
+		r.Close()
+		catch(err)
+		if !bytes.Equal(v, []byte("loaded")) {
+			t.Fatalf("Expected v == %q, got %q", "loaded", v)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected 1 loader call(s), got %d", calls)
+	}
+
+	loadErr := errors.New("load failed")
+	for i := 0; i < 2; i++ {
+		_, err = s.GetOrLoad("b", func() ([]byte, error) {
+			calls++
+			return nil, loadErr
+		})
+		if err != loadErr {
+			t.Fatalf("Expected err == %q, got %q", loadErr, err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("Expected 3 loader call(s), got %d", calls)
+	}
+	assertKeys(t, s.Keys(), []string{"a"})
+}
+
+func TestCacheGetOrLoadCorrupt(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithVerify(true))
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"f"})
+	catch(s.Put("a", []byte("abcdef")))
+	catch(ioutil.WriteFile(filepath.Join(storageDir, "a"), []byte("abcdeX"), 0666))
+
+	r, err := s.GetOrLoad("a", func() ([]byte, error) {
+		return []byte("loaded"), nil
+	})
+	catch(err)
+	v, err := ioutil.ReadAll(r)
+	r.Close()
+	catch(err)
+	if string(v) != "loaded" {
+		t.Fatalf("Expected v == %q, got %q", "loaded", v)
+	}
+	if v, err := s.GetString("a"); err != nil || v != "loaded" {
+		t.Fatalf("Expected a == %q stored back, got %q and %v", "loaded", v, err)
+	}
 }
 
-func TestCapEviction(t *testing.T) {
+func TestCacheGetOrLoadConcurrent(t *testing.T) {
 	clearStorage()
 
-	s, err := New(storageDir, 2048, 3, false)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
 
-	err = s.Put("a", []byte("abcdefg"))
+	var calls int32
+	release := make(chan struct{})
+	loader := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("loaded"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.GetOrLoad("a", loader)
+			catch(err)
+			v, err := ioutil.ReadAll(r)
+			r.Close()
+			catch(err)
+			if !bytes.Equal(v, []byte("loaded")) {
+				t.Errorf("Expected v == %q, got %q", "loaded", v)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("Expected 1 loader call(s), got %d", n)
+	}
+	if len(s.loads.m) != 0 {
+		t.Fatalf("Expected no loads in flight, got %d", len(s.loads.m))
+	}
+}
+
+func TestCacheGetConcurrent(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
-	err = s.Put("b", []byte("hi"))
+	for k, b := range blobs {
+		err := s.Put(k, b)
+		catch(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k, b := range blobs {
+				r, err := s.Get(k)
+				catch(err)
+				v, err := ioutil.ReadAll(r)
+				r.Close()
+				catch(err)
+				if !bytes.Equal(b, v) {
+					t.Errorf("Expected v == %q, got %q", b, v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDelete(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("de"))
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"a", "b"})
 
-	err = s.Put("c", []byte("k"))
+	err = s.Delete("a")
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"a", "b", "c"})
+	assertKeys(t, s.Keys(), []string{"b"})
+	if n := s.Size(); n != 2 {
+		t.Fatalf("Expected Size() == 2, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("Expected file to be removed, got %v", err)
+	}
+	if err := s.Delete("a"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+}
 
-	err = s.Put("d", []byte("l"))
+func TestSharded(t *testing.T) {
+	clearStorage()
+
+	s, err := NewSharded(storageDir, 4, WithMaxSize(2048000), WithMaxEntries(40))
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"b", "c", "d"})
+	for k, b := range blobs {
+		err := s.Put(k, b)
+		catch(err)
+	}
 
-	err = s.Put("e", []byte("m"))
+	keys := []string{}
+	for k, b := range blobs {
+		keys = append(keys, k)
+		r, err := s.Get(k)
+		catch(err)
+		v, err := ioutil.ReadAll(r)
+		r.Close()
+		catch(err)
+		if !bytes.Equal(b, v) {
+			t.Fatalf("Expected v == %q, got %q", b, v)
+		}
+	}
+	sort.Strings(keys)
+	assertKeys(t, s.Keys(), keys)
+	if n := s.Len(); n != int64(len(blobs)) {
+		t.Fatalf("Expected Len() == %d, got %d", len(blobs), n)
+	}
+
+	err = s.Delete("gopher")
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"c", "d", "e"})
+	if s.Has("gopher") {
+		t.Fatalf("Expected Has(%q) == false", "gopher")
+	}
 
-	err = s.Put("f", []byte("nopqrstuv"))
+	if _, err := NewSharded(storageDir, 0, WithMaxSize(2048000), WithMaxEntries(40)); err != ErrBadShards {
+		t.Fatalf("Expected err == %q, got %q", ErrBadShards, err)
+	}
+	if _, err := NewSharded(storageDir, 4, WithMaxSize(2048000), WithMaxEntries(3)); err != ErrTooManyShards {
+		t.Fatalf("Expected err == %q, got %q", ErrTooManyShards, err)
+	}
+	if _, err := NewSharded(storageDir, 4, WithMaxSize(3), WithMaxEntries(40)); err != ErrTooManyShards {
+		t.Fatalf("Expected err == %q, got %q", ErrTooManyShards, err)
+	}
+	if _, err := NewSharded(storageDir, 4, WithMaxSize(2048000)); err != ErrBadCap {
+		t.Fatalf("Expected err == %q, got %q", ErrBadCap, err)
+	}
+
+	// Shards created before one fails are closed, which saves their index.
+	clearStorage()
+	err = ioutil.WriteFile(filepath.Join(storageDir, "01"), nil, 0666)
 	catch(err)
-	assertKeys(t, s.Keys(), []string{"d", "e", "f"})
+	if _, err := NewSharded(storageDir, 4, WithMaxSize(2048000), WithMaxEntries(40), WithIndex(true)); err == nil {
+		t.Fatalf("Expected NewSharded to fail")
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "00", indexFile)); err != nil {
+		t.Fatalf("Expected the first shard to be closed, got %v", err)
+	}
 }
 
-func TestMain(m *testing.M) {
-	// Create a temporary storage directory for tests
-	name, err := ioutil.TempDir("", "stash-")
-	if err != nil {
-		log.Fatal(err)
+func TestHas(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+
+	if !s.Has("a") {
+		t.Fatalf("Expected Has(%q) == true", "a")
+	}
+	if s.Has("c") {
+		t.Fatalf("Expected Has(%q) == false", "c")
 	}
-	storageDir = name
-	defer os.RemoveAll(name)
 
-	os.Exit(m.Run())
+	// Has must not promote a, so it is still the first to go.
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c"})
 }
 
-func assertKeys(t *testing.T, keys []string, expected []string) {
-	if len(keys) != len(expected) {
-		t.Fatalf("Expected %d key(s), got %d", len(expected), len(keys))
+func TestPutWithTTL(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	err = s.PutWithTTL("a", []byte("stale"), time.Millisecond)
+	catch(err)
+	err = s.PutWithTTL("b", []byte("fresh"), time.Hour)
+	catch(err)
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Expired entries count as missing before Get gets around to removing them.
+	if s.Has("a") {
+		t.Fatalf("Expected Has to report an expired key missing")
 	}
-	if !reflect.DeepEqual(keys, expected) {
-		t.Fatalf("Expected keys == %q, got %q", expected, keys)
+	if _, err := s.Stat("a"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+	assertKeys(t, s.Keys(), []string{"b"})
+
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("Expected expired file to be removed, got %v", err)
+	}
+	r, err := s.Get("b")
+	catch(err)
+	r.Close()
+	assertKeys(t, s.Keys(), []string{"b"})
+
+	// Counters keep their expiry, and start over once expired.
+	catch(s.PutWithTTL("live", []byte("5"), time.Hour))
+	catch(s.PutWithTTL("dead", []byte("5"), time.Millisecond))
+	before, err := s.Stat("live")
+	catch(err)
+	time.Sleep(10 * time.Millisecond)
+	for key, want := range map[string]int64{"live": 6, "dead": 1} {
+		n, err := s.Increment(key, 1)
+		catch(err)
+		if n != want {
+			t.Fatalf("Expected %s == %d, got %d", key, want, n)
+		}
+	}
+	if m, err := s.Stat("live"); err != nil || !m.Expires.Equal(before.Expires) {
+		t.Fatalf("Expected expiry %v kept, got %v, %v", before.Expires, m.Expires, err)
+	}
+	if m, err := s.Stat("dead"); err != nil || !m.Expires.IsZero() {
+		t.Fatalf("Expected no expiry, got %v, %v", m.Expires, err)
+	}
+}
+
+func TestRange(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("de"))
+	catch(err)
+	err = s.Put("c", []byte("f"))
+	catch(err)
+
+	keys := []string{}
+	size := int64(0)
+	err = s.Range(func(m Meta) bool {
+		keys = append(keys, m.Key)
+		size += m.Size
+		return m.Key != "b"
+	})
+	catch(err)
+	if !reflect.DeepEqual(keys, []string{"c", "b"}) {
+		t.Fatalf("Expected keys == %q, got %q", []string{"c", "b"}, keys)
+	}
+	if size != 3 {
+		t.Fatalf("Expected size == 3, got %d", size)
+	}
+}
+
+func TestRangeCopiesHeader(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	catch(s.PutWithMeta("a", []byte("abc"), map[string]string{"type": "text/plain"}))
+
+	catch(s.Range(func(m Meta) bool {
+		m.Header["type"] = "changed"
+		return true
+	}))
+	m, err := s.Stat("a")
+	catch(err)
+	if m.Header["type"] != "text/plain" {
+		t.Fatalf("Expected header left alone, got %v", m.Header)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+
+	r, err := s.Peek("a")
+	catch(err)
+	v, err := ioutil.ReadAll(r)
+	r.Close()
+	catch(err)
+	if !bytes.Equal(v, []byte("abc")) {
+		t.Fatalf("Expected v == %q, got %q", "abc", v)
+	}
+	if _, err := s.Peek("c"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+
+	// Peek must not promote a, so it is still the first to go.
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c"})
+}
+
+func TestStat(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a/b", []byte("abc"))
+	catch(err)
+
+	m, err := s.Stat("a/b")
+	catch(err)
+	if m.Key != "a/b" || m.Size != 3 || m.Path != filepath.Join(storageDir, escape("a/b")) {
+		t.Fatalf("Unexpected meta %+v", m)
+	}
+
+	m.Size = 100
+	if m, _ := s.Stat("a/b"); m.Size != 3 {
+		t.Fatalf("Expected Stat to return a copy, got size %d", m.Size)
+	}
+	if _, err := s.Stat("c"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+
+	n, err := s.Increment("counter", 5)
+	catch(err)
+	if n != 5 {
+		t.Fatalf("Expected n == 5, got %d", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Increment("counter", 1)
+			catch(err)
+		}()
+	}
+	wg.Wait()
+
+	n, err = s.Increment("counter", -3)
+	catch(err)
+	if n != 12 {
+		t.Fatalf("Expected n == 12, got %d", n)
+	}
+
+	err = s.Put("text", []byte("abc"))
+	catch(err)
+	_, err = s.Increment("text", 1)
+	if err == nil {
+		t.Fatalf("Expected err != nil for non-integer blob")
+	}
+
+	// Counters keep their header, and stay ephemeral.
+	catch(s.PutWithMeta("hits", []byte("1"), map[string]string{"type": "counter"}))
+	_, err = s.Increment("hits", 1)
+	catch(err)
+	m, err := s.Stat("hits")
+	catch(err)
+	if m.Header["type"] != "counter" {
+		t.Fatalf("Expected header kept, got %v", m.Header)
+	}
+	if h, err := readHeader(m.Path); err != nil || h["type"] != "counter" {
+		t.Fatalf("Expected header kept on disk, got %v, %v", h, err)
+	}
+	catch(s.PutEphemeral("visits", []byte("1")))
+	_, err = s.Increment("visits", 1)
+	catch(err)
+	m, err = s.Stat("visits")
+	catch(err)
+	if !isEphemeral(filepath.Base(m.Path)) {
+		t.Fatalf("Expected counter to stay ephemeral, got %s", m.Path)
+	}
+}
+
+func TestWarmupHashedNames(t *testing.T) {
+	clearStorage()
+
+	long := strings.Repeat("long/key/", 40)
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithHashedNames(true))
+	catch(err)
+	for k, b := range blobs {
+		err := s.Put(k, b)
+		catch(err)
+	}
+	err = s.Put(long, []byte("long"))
+	catch(err)
+	err = s.Put(long, []byte("longer"))
+	catch(err)
+
+	// Simulate a restart
+	s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithHashedNames(true))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+
+	keys := []string{long}
+	for k := range blobs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assertKeys(t, s.Keys(), keys)
+
+	v, err := s.GetBytes(long)
+	catch(err)
+	if !bytes.Equal(v, []byte("longer")) {
+		t.Fatalf("Expected v == %q, got %q", "longer", v)
+	}
+	for k, b := range blobs {
+		v, err := s.GetBytes(k)
+		catch(err)
+		if !bytes.Equal(b, v) {
+			t.Fatalf("Expected v == %q, got %q", b, v)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(3), WithIndex(true))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+	_, err = s.GetBytes("a")
+	catch(err)
+	err = s.PutEphemeral("d", []byte("jkl"))
+	catch(err)
+	err = s.Close()
+	catch(err)
+
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(3), WithIndex(true))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "c"})
+	if _, err := os.Stat(filepath.Join(storageDir, indexFile)); !os.IsNotExist(err) {
+		t.Fatalf("Expected index file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, ephemeralPrefix+"d")); !os.IsNotExist(err) {
+		t.Fatalf("Expected ephemeral file to be removed, got %v", err)
+	}
+
+	// Recency is preserved: c is the least recently used entry.
+	err = s.Put("e", []byte("mno"))
+	catch(err)
+	err = s.Put("f", []byte("pqr"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "e", "f"})
+
+	// Without an index file, New falls back to Warmup.
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(3), WithIndex(true))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "e", "f"})
+}
+
+func TestIndexUntrusted(t *testing.T) {
+	clearStorage()
+
+	outside := filepath.Join(filepath.Dir(storageDir), filepath.Base(storageDir)+"-outside")
+	catch(ioutil.WriteFile(outside, []byte("abc"), 0666))
+	defer os.Remove(outside)
+	for _, k := range []string{"a", "b", "c"} {
+		catch(ioutil.WriteFile(filepath.Join(storageDir, k), []byte("abc"), 0666))
+	}
+	entries := []indexEntry{
+		{Key: "x", Name: filepath.Join("..", filepath.Base(outside)), Size: 3},
+		{Key: "y", Name: "a", Size: 3},
+		{Key: "a", Name: "a", Size: 3},
+		{Key: "a", Name: "a", Size: 3},
+		{Key: "gone", Name: "gone", Size: 3},
+		{Key: "b", Name: "b", Size: 3},
+		{Key: "c", Name: "c", Size: 3},
+	}
+	b, err := json.Marshal(entries)
+	catch(err)
+	catch(ioutil.WriteFile(filepath.Join(storageDir, indexFile), b, 0666))
+
+	// Bad names, duplicates and missing files are left out, and c is evicted to fit the smaller limit.
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2), WithIndex(true))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+	if s.Size() != 6 {
+		t.Fatalf("Expected size 6, got %d", s.Size())
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "c")); !os.IsNotExist(err) {
+		t.Fatalf("Expected c to be evicted, got %v", err)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("Expected the file outside the storage directory left alone, got %v", err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	a, err := s.Namespace("a")
+	catch(err)
+	b, err := s.Namespace("b")
+	catch(err)
+	if ns, _ := s.Namespace("a"); ns != a {
+		t.Fatalf("Expected the same cache for the same namespace")
+	}
+
+	err = s.Put("k", []byte("root"))
+	catch(err)
+	err = a.Put("k", []byte("a"))
+	catch(err)
+	err = b.Put("k", []byte("b"))
+	catch(err)
+	for c, v := range map[*Cache]string{s: "root", a: "a", b: "b"} {
+		got, err := c.GetBytes("k")
+		catch(err)
+		if string(got) != v {
+			t.Fatalf("Expected v == %q, got %q", v, got)
+		}
+	}
+
+	// Limits are per namespace.
+	err = a.Put("l", []byte("a"))
+	catch(err)
+	err = a.Put("m", []byte("a"))
+	catch(err)
+	assertKeys(t, a.Keys(), []string{"l", "m"})
+	assertKeys(t, b.Keys(), []string{"k"})
+	assertKeys(t, s.Keys(), []string{"k"})
+
+	// Namespaces survive a restart and compaction of the parent.
+	err = s.CompactLayout()
+	catch(err)
+	catch(s.Close())
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"k"})
+	a, err = s.Namespace("a")
+	catch(err)
+	err = a.Warmup()
+	catch(err)
+	assertKeys(t, a.Keys(), []string{"l", "m"})
+}
+
+func TestClose(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Close()
+	catch(err)
+
+	if err := s.Put("b", []byte("def")); err != ErrClosed {
+		t.Fatalf("Expected err == %q, got %q", ErrClosed, err)
+	}
+	if _, err := s.Get("a"); err != ErrClosed {
+		t.Fatalf("Expected err == %q, got %q", ErrClosed, err)
+	}
+	if err := s.Delete("a"); err != ErrClosed {
+		t.Fatalf("Expected err == %q, got %q", ErrClosed, err)
+	}
+	if err := s.Close(); err != ErrClosed {
+		t.Fatalf("Expected err == %q, got %q", ErrClosed, err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "a")); err != nil {
+		t.Fatalf("Expected blob to outlive Close, got %v", err)
+	}
+}
+
+func TestWarmupRecency(t *testing.T) {
+	clearStorage()
+
+	now := time.Now()
+	for i, k := range []string{"b", "c", "a"} {
+		path := filepath.Join(storageDir, k)
+		err := ioutil.WriteFile(path, []byte(k), 0666)
+		catch(err)
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		err = os.Chtimes(path, mtime, mtime)
+		catch(err)
+	}
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(3))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+
+	// b was modified longest ago, then c.
+	err = s.Put("d", []byte("d"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "c", "d"})
+	err = s.Put("e", []byte("e"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "d", "e"})
+}
+
+func TestWarmupEphemeral(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("persistent"))
+	catch(err)
+	err = s.PutEphemeral("b", []byte("ephemeral"))
+	catch(err)
+
+	r, err := s.Get("b")
+	catch(err)
+	v, err := ioutil.ReadAll(r)
+	r.Close()
+	catch(err)
+	if !bytes.Equal(v, []byte("ephemeral")) {
+		t.Fatalf("Expected v == %q, got %q", "ephemeral", v)
+	}
+
+	// Simulate a restart
+	s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+
+	assertKeys(t, s.Keys(), []string{"a"})
+	if _, err := s.Get("b"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, ephemeralPrefix+"b")); !os.IsNotExist(err) {
+		t.Fatalf("Expected ephemeral file to be removed, got %v", err)
+	}
+}
+
+func TestWarmupStrayFiles(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+
+	// Leave a subdirectory and the file of an interrupted write behind.
+	err = os.Mkdir(filepath.Join(storageDir, "sub"), 0777)
+	catch(err)
+	err = ioutil.WriteFile(filepath.Join(storageDir, tempPrefix+"b"), []byte("partial"), 0666)
+	catch(err)
+
+	// Simulate a restart
+	s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+
+	assertKeys(t, s.Keys(), []string{"a"})
+	if s.Size() != 3 {
+		t.Fatalf("Expected size 3, got %d", s.Size())
+	}
+}
+
+func TestWarmupTwice(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.PutEphemeral("b", []byte("def"))
+	catch(err)
+
+	err = s.Warmup()
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+	if s.Size() != 6 || s.Len() != 2 {
+		t.Fatalf("Expected size 6 and len 2, got %d and %d", s.Size(), s.Len())
+	}
+	v, err := s.GetBytes("b")
+	catch(err)
+	if !bytes.Equal(v, []byte("def")) {
+		t.Fatalf("Expected v == %q, got %q", "def", v)
+	}
+}
+
+func TestWarmupMissingDir(t *testing.T) {
+	clearStorage()
+
+	dir := filepath.Join(storageDir, "missing")
+	s, err := New(dir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = os.Remove(dir) // New creates the directory; remove it behind the cache's back.
+	catch(err)
+	err = s.Warmup()
+	if err, ok := err.(*FileError); !ok || err.Dir != dir || !os.IsNotExist(err.Err) {
+		t.Fatalf("Expected a *FileError for %q, got %v", dir, err)
+	}
+}
+
+func TestWarmupConcurrency(t *testing.T) {
+	clearStorage()
+
+	// Give every file the same modification time, so that only names decide the order.
+	mtime := time.Now().Add(-time.Hour)
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(storageDir, strconv.Itoa(i))
+		err := ioutil.WriteFile(path, []byte("abc"), 0666)
+		catch(err)
+		err = os.Chtimes(path, mtime, mtime)
+		catch(err)
+	}
+
+	var order []string
+	for _, n := range []int{1, 16} {
+		s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(100), WithWarmupConcurrency(n))
+		catch(err)
+		err = s.Warmup()
+		catch(err)
+		if s.Len() != 50 || s.Size() != 150 {
+			t.Fatalf("Expected len 50 and size 150, got %d and %d", s.Len(), s.Size())
+		}
+		var keys []string
+		err = s.Range(func(m Meta) bool {
+			keys = append(keys, m.Key)
+			return true
+		})
+		catch(err)
+		if order != nil && !reflect.DeepEqual(keys, order) {
+			t.Fatalf("Expected order %q, got %q", order, keys)
+		}
+		order = keys
+	}
+}
+
+func TestWarmupKeys(t *testing.T) {
+	for _, hashNames := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithHashedNames(hashNames))
+		catch(err)
+		for _, k := range []string{"a", "b", "c"} {
+			err := s.Put(k, []byte("abc"))
+			catch(err)
+		}
+
+		s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithHashedNames(hashNames))
+		catch(err)
+		err = s.WarmupKeys([]string{"c", "a", "x", "a"})
+		catch(err)
+		assertKeys(t, s.Keys(), []string{"a", "c"})
+		if n := s.Size(); n != 6 {
+			t.Fatalf("hashNames=%v: Expected Size() == 6, got %d", hashNames, n)
+		}
+		b, err := s.GetBytes("c")
+		catch(err)
+		if string(b) != "abc" {
+			t.Fatalf("hashNames=%v: Expected %q, got %q", hashNames, "abc", b)
+		}
+	}
+}
+
+func TestWarmupSince(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	catch(s.PutWithMeta("old", []byte("abc"), map[string]string{"a": "b"}))
+	catch(s.Put("new", []byte("def")))
+	catch(s.Close())
+
+	cutoff := time.Now().Add(-time.Hour)
+	old := cutoff.Add(-time.Hour)
+	catch(os.Chtimes(filepath.Join(storageDir, "old"), old, old))
+
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	catch(s.WarmupSince(cutoff))
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"new"}) {
+		t.Fatalf("Expected keys [new], got %v", keys)
+	}
+	for _, name := range []string{"old", headerPrefix + "old"} {
+		if _, err := os.Stat(filepath.Join(storageDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted, got %v", name, err)
+		}
+	}
+}
+
+func TestWarmupMixedCompression(t *testing.T) {
+	clearStorage()
+
+	a := bytes.Repeat([]byte("a"), 1000)
+	b := bytes.Repeat([]byte("b"), 1000)
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true))
+	catch(err)
+	catch(s.Put("a", a))
+	catch(s.Close())
+	s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	catch(s.Put("b", b))
+	catch(s.Put("short", []byte("ab")))
+	catch(s.Close())
+
+	for _, deflate := range []bool{false, true} {
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(deflate))
+		catch(err)
+		catch(s.Warmup())
+		for k, want := range map[string][]byte{"a": a, "b": b, "short": []byte("ab")} {
+			v, err := s.GetBytes(k)
+			catch(err)
+			if !bytes.Equal(v, want) {
+				t.Fatalf("Expected %s == %q, got %q", k, want, v)
+			}
+			m, err := s.Stat(k)
+			catch(err)
+			if m.Compressed != (k == "a") {
+				t.Fatalf("Expected %s Compressed == %v, got %v", k, k == "a", m.Compressed)
+			}
+		}
+		catch(s.Close())
+	}
+}
+
+func TestGetFallback(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+
+	calls := 0
+	s.SetFallbacks(
+		func(key string) (io.ReadCloser, error) {
+			calls++
+			return nil, errors.New("replica unavailable")
+		},
+		func(key string) (io.ReadCloser, error) {
+			calls++
+			if key != "a" {
+				return nil, ErrNotFound
+			}
+			return ioutil.NopCloser(bytes.NewReader([]byte("from replica"))), nil
+		},
+	)
+
+	for i := 0; i < 2; i++ {
+		r, err := s.Get("a")
+		catch(err)
+		v, err := ioutil.ReadAll(r)
+		r.Close()
+		catch(err)
+		if !bytes.Equal(v, []byte("from replica")) {
+			t.Fatalf("Expected v == %q, got %q", "from replica", v)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 fallback call(s), got %d", calls)
+	}
+	assertKeys(t, s.Keys(), []string{"a"})
+
+	if _, err := s.Get("b"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+}
+
+func TestClear(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	for k, b := range blobs {
+		err := s.Put(k, b)
+		catch(err)
+	}
+
+	err = s.Clear()
+	catch(err)
+
+	assertKeys(t, s.Keys(), []string{})
+	if n := s.Size(); n != 0 {
+		t.Fatalf("Expected Size() == 0, got %d", n)
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("Expected Len() == 0, got %d", n)
+	}
+	for k := range blobs {
+		if _, err := os.Stat(filepath.Join(storageDir, escape(k))); !os.IsNotExist(err) {
+			t.Fatalf("Expected file for %q to be removed, got %v", k, err)
+		}
+	}
+}
+
+func TestCompactLayout(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(3))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+	r, err := s.Get("a")
+	catch(err)
+	r.Close()
+
+	stray := filepath.Join(storageDir, "stray")
+	err = ioutil.WriteFile(stray, []byte("debris"), 0666)
+	catch(err)
+
+	err = s.CompactLayout()
+	catch(err)
+
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Fatalf("Expected stray file to be removed, got %v", err)
+	}
+	// Recency is preserved: b is the least recently used entry.
+	err = s.Put("d", []byte("jkl"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "c", "d"})
+
+	for k, b := range map[string][]byte{"a": []byte("abc"), "c": []byte("ghi"), "d": []byte("jkl")} {
+		r, err := s.Get(k)
+		catch(err)
+		v, err := ioutil.ReadAll(r)
+		r.Close()
+		catch(err)
+		if !bytes.Equal(b, v) {
+			t.Fatalf("Expected v == %q, got %q", b, v)
+		}
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithWriteOnce(true))
+	catch(err)
+	err = s.Put("a", []byte("first"))
+	catch(err)
+
+	err = s.Put("a", []byte("second"))
+	if err != ErrAlreadyExists {
+		t.Fatalf("Expected err == %q, got %q", ErrAlreadyExists, err)
+	}
+
+	r, err := s.Get("a")
+	catch(err)
+	v, err := ioutil.ReadAll(r)
+	r.Close()
+	catch(err)
+	if !bytes.Equal(v, []byte("first")) {
+		t.Fatalf("Expected v == %q, got %q", "first", v)
+	}
+
+	// The deprecated constructor still works.
+	s, err = NewWriteOnce(storageDir, 2048000, 40, false)
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+	if err := s.Put("a", []byte("second")); err != ErrAlreadyExists {
+		t.Fatalf("Expected err == %q, got %q", ErrAlreadyExists, err)
+	}
+}
+
+func TestSizeEviction(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(10), WithMaxEntries(40))
+	catch(err)
+
+	err = s.Put("a", []byte("abcdefgh"))
+	catch(err)
+	err = s.Put("b", []byte("ij"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+
+	err = s.Put("c", []byte("k"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c"})
+
+	err = s.Put("d", []byte("l"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c", "d"})
+
+	err = s.Put("e", []byte("m"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c", "d", "e"})
+
+	err = s.Put("f", []byte("nopqrstuvw"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"f"})
+}
+
+func TestPutOverwrite(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+
+	err = s.Put("a", []byte("abcdefgh"))
+	catch(err)
+	err = s.Put("a", []byte("ij"))
+	catch(err)
+	if n := s.Size(); n != 2 {
+		t.Fatalf("Expected Size() == 2, got %d", n)
+	}
+	if n := s.Len(); n != 1 {
+		t.Fatalf("Expected Len() == 1, got %d", n)
+	}
+}
+
+func TestPutOverwriteLast(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(6), WithMaxEntries(2))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+
+	// a is next in line for eviction, but replacing it must not evict it along with its new file.
+	err = s.Put("a", []byte("ghi"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+	v, err := s.GetBytes("a")
+	catch(err)
+	if !bytes.Equal(v, []byte("ghi")) {
+		t.Fatalf("Expected v == %q, got %q", "ghi", v)
+	}
+}
+
+func TestPutTooLargeEmpty(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(6), WithMaxEntries(2))
+	catch(err)
+
+	done := make(chan error)
+	go func() {
+		done <- s.PutReader("a", bytes.NewReader([]byte("abcdefg")))
+	}()
+	select {
+	case err := <-done:
+		if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+			t.Fatalf("Expected err == %q, got %q", ErrTooLarge, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Put into an empty cache did not return")
+	}
+	assertKeys(t, s.Keys(), []string{})
+}
+
+func TestPutTooLarge(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(10), WithMaxEntries(40))
+	catch(err)
+
+	err = s.Put("a", []byte("abcdefghijk"))
+	if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+		t.Fatalf("Expected err == %q, got %q", ErrTooLarge, err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file to be written, got %v", err)
+	}
+
+	// A reader of unknown length is cut off once it exceeds the cache size.
+	r := io.MultiReader(bytes.NewReader([]byte("abcdef")), bytes.NewReader([]byte("ghijk")))
+	err = s.PutReader("b", r)
+	if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+		t.Fatalf("Expected err == %q, got %q", ErrTooLarge, err)
+	}
+	if _, err := os.Stat(filepath.Join(storageDir, "b")); !os.IsNotExist(err) {
+		t.Fatalf("Expected partial file to be removed, got %v", err)
+	}
+	assertKeys(t, s.Keys(), []string{})
+}
+
+func TestStats(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+
+	r, err := s.Get("c")
+	catch(err)
+	r.Close()
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+
+	expected := Stats{Hits: 1, Misses: 1, Evictions: 1, Puts: 3, DiskUsed: 6, LogicalUsed: 6}
+	if st := s.Stats(); st != expected {
+		t.Fatalf("Expected stats == %+v, got %+v", expected, st)
+	}
+}
+
+func TestLFUEviction(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(3), WithPolicy(LFU))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+
+	for _, k := range []string{"a", "a", "a", "b", "c", "c", "c"} {
+		_, err := s.GetBytes(k)
+		catch(err)
+	}
+	_, err = s.GetBytes("b") // Most recent, but still less frequent than a and c
+	catch(err)
+
+	err = s.Put("d", []byte("jkl"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "c", "d"})
+
+	err = s.Put("e", []byte("mno"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "c", "e"})
+}
+
+func TestFIFOEviction(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2), WithPolicy(FIFO))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+	_, err = s.GetBytes("a")
+	catch(err)
+
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c"})
+}
+
+func TestOnEvict(t *testing.T) {
+	clearStorage()
+
+	var s *Cache
+	evicted := []string{}
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2), WithOnEvict(func(key string, size int64) {
+		evicted = append(evicted, key)
+		if size != 3 {
+			t.Errorf("Expected size == 3, got %d", size)
+		}
+		if s.Has(key) { // Must not deadlock
+			t.Errorf("Expected Has(%q) == false", key)
+		}
+	}))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+	err = s.Put("d", []byte("jkl"))
+	catch(err)
+
+	if !reflect.DeepEqual(evicted, []string{"a", "b"}) {
+		t.Fatalf("Expected evicted == %q, got %q", []string{"a", "b"}, evicted)
+	}
+}
+
+func TestResize(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+
+	n, err := s.Resize(7, 40)
+	catch(err)
+	if n != 2 {
+		t.Fatalf("Expected 2 eviction(s), got %d", n)
+	}
+	assertKeys(t, s.Keys(), []string{"c", "d"})
+
+	n, err = s.Resize(7, 1)
+	catch(err)
+	if n != 1 {
+		t.Fatalf("Expected 1 eviction(s), got %d", n)
+	}
+	assertKeys(t, s.Keys(), []string{"d"})
+
+	if _, err := s.Resize(0, 1); err != ErrBadSize {
+		t.Fatalf("Expected err == %q, got %q", ErrBadSize, err)
+	}
+	if _, err := s.Resize(7, 0); err != ErrBadCap {
+		t.Fatalf("Expected err == %q, got %q", ErrBadCap, err)
+	}
+}
+
+func TestWouldEvict(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(10), WithMaxEntries(3))
+	catch(err)
+	err = s.Put("a", []byte("abcde"))
+	catch(err)
+	err = s.Put("b", []byte("fg"))
+	catch(err)
+	err = s.Put("c", []byte("h"))
+	catch(err)
+
+	for _, c := range []struct {
+		size     int64
+		expected int
+	}{
+		{size: 0, expected: 1},
+		{size: 2, expected: 1},
+		{size: 6, expected: 1},
+		{size: 8, expected: 2},
+		{size: 10, expected: 3},
+		{size: 11, expected: -1},
+	} {
+		if n := s.WouldEvict(c.size); n != c.expected {
+			t.Fatalf("Expected WouldEvict(%d) == %d, got %d", c.size, c.expected, n)
+		}
+	}
+	assertKeys(t, s.Keys(), []string{"a", "b", "c"})
+}
+
+func TestPutReaderEndless(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(1<<20), WithMaxEntries(40), WithMaxEntrySize(1<<16), WithDeflate(deflate))
+		catch(err)
+
+		// An endless, incompressible stream must be cut off once it is too large.
+		var read int64
+		r := readerFunc(func(p []byte) (int, error) {
+			n, _ := rand.Read(p)
+			read += int64(n)
+			return n, nil
+		})
+		err = s.PutReader("a", r)
+		if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+			t.Fatalf("deflate=%v: Expected err == %q, got %q", deflate, ErrTooLarge, err)
+		}
+		if _, err := os.Stat(filepath.Join(storageDir, "a")); !os.IsNotExist(err) {
+			t.Fatalf("deflate=%v: Expected partial file to be removed, got %v", deflate, err)
+		}
+		if read > 1<<23 {
+			t.Fatalf("deflate=%v: Expected the stream to be cut off early, read %d byte(s)", deflate, read)
+		}
+	}
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(10), WithMaxEntries(40), WithMaxEntrySize(4))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("defg"))
+	catch(err)
+
+	err = s.Put("c", []byte("hijkl"))
+	if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+		t.Fatalf("Expected err == %q, got %q", ErrTooLarge, err)
+	}
+	err = s.PutReader("c", bytes.NewReader([]byte("hijkl")))
+	if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+		t.Fatalf("Expected err == %q, got %q", ErrTooLarge, err)
+	}
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+	if n := s.WouldEvict(5); n != -1 {
+		t.Fatalf("Expected WouldEvict(5) == -1, got %d", n)
+	}
+}
+
+func TestEmptyBlobs(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(3))
+	catch(err)
+	for i := 0; i < 2; i++ {
+		err = s.Put("a", []byte{})
+		catch(err)
+	}
+	err = s.Put("b", nil)
+	catch(err)
+	if n := s.Size(); n != 0 {
+		t.Fatalf("Expected Size() == 0, got %d", n)
+	}
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Expected Len() == 2, got %d", n)
+	}
+
+	v, err := s.GetBytes("a")
+	catch(err)
+	if len(v) != 0 {
+		t.Fatalf("Expected empty blob, got %q", v)
+	}
+
+	// Empty blobs take up no space, but still count against the entry cap.
+	err = s.Put("c", []byte{})
+	catch(err)
+	err = s.Put("d", []byte{})
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "c", "d"})
+	if n := s.Len(); n != 3 {
+		t.Fatalf("Expected Len() == 3, got %d", n)
+	}
+
+	err = s.Delete("c")
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "d"})
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Expected Len() == 2, got %d", n)
+	}
+	if n := s.Size(); n != 0 {
+		t.Fatalf("Expected Size() == 0, got %d", n)
+	}
+}
+
+func TestCapEviction(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(3))
+	catch(err)
+
+	err = s.Put("a", []byte("abcdefg"))
+	catch(err)
+	err = s.Put("b", []byte("hi"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+
+	err = s.Put("c", []byte("k"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "b", "c"})
+
+	err = s.Put("d", []byte("l"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c", "d"})
+
+	err = s.Put("e", []byte("m"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"c", "d", "e"})
+
+	err = s.Put("f", []byte("nopqrstuv"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"d", "e", "f"})
+}
+
+func TestRename(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(3))
+	catch(err)
+	for _, k := range []string{"a", "b", "c"} {
+		err := s.Put(k, []byte(k))
+		catch(err)
+	}
+
+	if err := s.Rename("x", "y"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+
+	err = s.Rename("a", "tmp/a")
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c", "tmp/a"})
+	v, err := s.GetBytes("tmp/a")
+	catch(err)
+	if !bytes.Equal(v, []byte("a")) {
+		t.Fatalf("Expected v == %q, got %q", "a", v)
+	}
+
+	// Renaming over b overwrites it.
+	err = s.Rename("tmp/a", "b")
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c"})
+	if s.Size() != 2 || s.Len() != 2 {
+		t.Fatalf("Expected size 2 and len 2, got %d and %d", s.Size(), s.Len())
+	}
+	v, err = s.GetBytes("b")
+	catch(err)
+	if !bytes.Equal(v, []byte("a")) {
+		t.Fatalf("Expected v == %q, got %q", "a", v)
+	}
+
+	// The renamed entry keeps its place in the eviction order.
+	err = s.Rename("c", "d")
+	catch(err)
+	err = s.Put("e", []byte("e"))
+	catch(err)
+	err = s.Put("f", []byte("f"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "e", "f"})
+}
+
+func TestGetFile(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithDeflate(true))
+	catch(err)
+	err = s.Put("gopher", blobs["gopher"])
+	catch(err)
+
+	dst := filepath.Join(storageDir, "..", filepath.Base(storageDir)+"-gopher")
+	defer os.Remove(dst)
+	err = s.GetFile("gopher", dst)
+	catch(err)
+	b, err := ioutil.ReadFile(dst)
+	catch(err)
+	if !bytes.Equal(b, blobs["gopher"]) {
+		t.Fatalf("Expected contents == %q, got %q", blobs["gopher"], b)
+	}
+
+	if err := s.GetFile("missing", dst); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir+string(os.PathSeparator), WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	if s.Dir() != storageDir {
+		t.Fatalf("Expected dir == %q, got %q", storageDir, s.Dir())
+	}
+	if s.MaxSize() != 2048 || s.MaxEntries() != 40 {
+		t.Fatalf("Expected limits 2048 and 40, got %d and %d", s.MaxSize(), s.MaxEntries())
+	}
+
+	_, err = s.Resize(1024, 20)
+	catch(err)
+	if s.MaxSize() != 1024 || s.MaxEntries() != 20 {
+		t.Fatalf("Expected limits 1024 and 20, got %d and %d", s.MaxSize(), s.MaxEntries())
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithDeflate(deflate), WithVerify(true))
+		catch(err)
+		err = s.Append("log", []byte("abc"))
+		catch(err)
+		err = s.Append("log", []byte("def"))
+		catch(err)
+
+		v, err := s.GetBytes("log")
+		catch(err)
+		if !bytes.Equal(v, []byte("abcdef")) {
+			t.Fatalf("Expected v == %q, got %q", "abcdef", v)
+		}
+		m, err := s.Stat("log")
+		catch(err)
+		if s.Size() != m.Size || s.Len() != 1 {
+			t.Fatalf("Expected size %d and len 1, got %d and %d", m.Size, s.Size(), s.Len())
+		}
+
+		// Appending to an expired blob starts a new one.
+		err = s.PutWithTTL("tmp", []byte("abc"), time.Millisecond)
+		catch(err)
+		time.Sleep(10 * time.Millisecond)
+		err = s.Append("tmp", []byte("def"))
+		catch(err)
+		v, err = s.GetBytes("tmp")
+		catch(err)
+		if !bytes.Equal(v, []byte("def")) {
+			t.Fatalf("Expected v == %q, got %q", "def", v)
+		}
+	}
+
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(8), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("log", []byte("abc"))
+	catch(err)
+
+	// Growing log past the size of the cache evicts a.
+	err = s.Append("log", []byte("defg"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"log"})
+	if s.Size() != 7 {
+		t.Fatalf("Expected size 7, got %d", s.Size())
+	}
+
+	err = s.Append("log", []byte("hi"))
+	if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+		t.Fatalf("Expected err == %q, got %q", ErrTooLarge, err)
+	}
+	v, err := s.GetBytes("log")
+	catch(err)
+	if !bytes.Equal(v, []byte("abcdefg")) {
+		t.Fatalf("Expected v == %q, got %q", "abcdefg", v)
+	}
+}
+
+func TestBadKey(t *testing.T) {
+	clearStorage()
+
+	dir := filepath.Join(storageDir, "cache")
+	err := os.Mkdir(dir, 0777)
+	catch(err)
+	s, err := New(dir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+
+	for _, k := range []string{"", ".", ".."} {
+		if err := s.Put(k, []byte("abc")); err != ErrBadKey {
+			t.Fatalf("%q: Expected err == %q, got %q", k, ErrBadKey, err)
+		}
+	}
+	if err := s.Put("a", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename("a", ".."); err != ErrBadKey {
+		t.Fatalf("Expected err == %q, got %q", ErrBadKey, err)
+	}
+
+	// Keys with separators are escaped, and stay inside the storage directory.
+	for _, k := range []string{"../../etc/passwd", "../escaped", `..\escaped`} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+		m, err := s.Stat(k)
+		catch(err)
+		if filepath.Dir(m.Path) != dir {
+			t.Fatalf("%q: Expected blob in %q, got %q", k, dir, m.Path)
+		}
+	}
+	files, err := ioutil.ReadDir(storageDir)
+	catch(err)
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 file(s) next to the storage directory, got %d", len(files))
+	}
+}
+
+func TestTrimToSize(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+
+	n, err := s.TrimToSize(7)
+	catch(err)
+	if n != 2 {
+		t.Fatalf("Expected 2 eviction(s), got %d", n)
+	}
+	assertKeys(t, s.Keys(), []string{"c", "d"})
+	if s.MaxSize() != 2048 {
+		t.Fatalf("Expected max size 2048, got %d", s.MaxSize())
+	}
+
+	n, err = s.TrimToSize(0)
+	catch(err)
+	if n != 2 || s.Size() != 0 {
+		t.Fatalf("Expected 2 eviction(s) and size 0, got %d and %d", n, s.Size())
+	}
+}
+
+func TestPutWithMeta(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	md := map[string]string{"Content-Type": "text/plain", "ETag": `"abc"`}
+	err = s.PutWithMeta("a", []byte("abc"), md)
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+
+	m, err := s.Stat("a")
+	catch(err)
+	if !reflect.DeepEqual(m.Header, md) {
+		t.Fatalf("Expected header == %v, got %v", md, m.Header)
+	}
+	m, err = s.Stat("b")
+	catch(err)
+	if m.Header != nil {
+		t.Fatalf("Expected no header, got %v", m.Header)
+	}
+
+	// Simulate a restart
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+	m, err = s.Stat("a")
+	catch(err)
+	if !reflect.DeepEqual(m.Header, md) {
+		t.Fatalf("Expected header == %v, got %v", md, m.Header)
+	}
+
+	// Overwriting the blob drops its header.
+	err = s.Put("a", []byte("ghi"))
+	catch(err)
+	m, err = s.Stat("a")
+	catch(err)
+	if m.Header != nil {
+		t.Fatalf("Expected no header, got %v", m.Header)
+	}
+	if _, err := os.Stat(headerPath(m.Path)); !os.IsNotExist(err) {
+		t.Fatalf("Expected header file to be removed, got %v", err)
+	}
+}
+
+func TestPutWriteError(t *testing.T) {
+	clearStorage()
+
+	var fail error
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithCodec(failCodec{&fail}))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("def"))
+	catch(err)
+
+	// A failed write leaves nothing behind.
+	fail = errors.New("device error")
+	if err := s.Put("c", []byte("ghi")); err == nil {
+		t.Fatalf("Expected write to fail")
+	}
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+	files, err := ioutil.ReadDir(storageDir)
+	catch(err)
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 file(s), got %d", len(files))
+	}
+
+	// Running out of space evicts the least recently used entry and tries again.
+	fail = &os.PathError{Op: "write", Path: "c", Err: syscall.ENOSPC}
+	err = s.Put("c", []byte("ghi"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c"})
+	v, err := s.GetBytes("c")
+	catch(err)
+	if !bytes.Equal(v, []byte("ghi")) {
+		t.Fatalf("Expected v == %q, got %q", "ghi", v)
+	}
+
+	// However deeply the error is wrapped.
+	fail = fmt.Errorf("codec: %w", &os.SyscallError{Syscall: "write", Err: syscall.ENOSPC})
+	err = s.Put("d", []byte("jkl"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"c", "d"})
+}
+
+func TestMemoryTier(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithDeflate(true), WithMemoryTier(16))
+	catch(err)
+	err = s.Put("a", []byte("abcdefgh"))
+	catch(err)
+	err = s.Put("b", []byte("ijklmnop"))
+	catch(err)
+	err = s.Put("large", []byte("qrstuvwxyzqrstuvwxyz"))
+	catch(err)
+	for _, k := range []string{"a", "b", "large"} {
+		_, err := s.GetBytes(k)
+		catch(err)
+	}
+	v, err := s.GetBytes("large")
+	catch(err)
+	if !bytes.Equal(v, []byte("qrstuvwxyzqrstuvwxyz")) {
+		t.Fatalf("Expected v == %q, got %q", "qrstuvwxyzqrstuvwxyz", v)
+	}
+
+	// Both small blobs are served from memory, even with their files gone.
+	for _, k := range []string{"a", "b"} {
+		m, err := s.Stat(k)
+		catch(err)
+		err = os.Remove(m.Path)
+		catch(err)
+	}
+	v, err = s.GetBytes("a")
+	catch(err)
+	if !bytes.Equal(v, []byte("abcdefgh")) {
+		t.Fatalf("Expected v == %q, got %q", "abcdefgh", v)
+	}
+	_, err = s.GetBytes("b")
+	catch(err)
+
+	// Replacing a blob drops the copy in memory.
+	err = s.Put("a", []byte("ABCDEFGH"))
+	catch(err)
+	v, err = s.GetBytes("a")
+	catch(err)
+	if !bytes.Equal(v, []byte("ABCDEFGH")) {
+		t.Fatalf("Expected v == %q, got %q", "ABCDEFGH", v)
+	}
+}
+
+func TestFileErrorUnwrap(t *testing.T) {
+	clearStorage()
+
+	s, err := New(filepath.Join(storageDir, "missing"), WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = os.Remove(filepath.Join(storageDir, "missing"))
+	catch(err)
+	err = s.Warmup()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected err to be %q, got %q", os.ErrNotExist, err)
+	}
+	var perr *os.PathError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected err to be a *os.PathError, got %T", err)
+	}
+
+	s, err = New(storageDir, WithMaxSize(2), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Expected err to be %q, got %q", ErrTooLarge, err)
+	}
+	var ferr *FileError
+	if !errors.As(err, &ferr) || ferr.Key != "a" {
+		t.Fatalf("Expected err to be a *FileError for %q, got %v", "a", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"a", "b", "c"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+
+	bad, err := s.Verify()
+	catch(err)
+	if len(bad) != 0 {
+		t.Fatalf("Expected 0 inconsistent entries, got %d", len(bad))
+	}
+
+	// Tamper with the files of a and b behind the cache's back.
+	err = os.Remove(filepath.Join(storageDir, "a"))
+	catch(err)
+	err = ioutil.WriteFile(filepath.Join(storageDir, "b"), []byte("abcdef"), 0666)
+	catch(err)
+
+	bad, err = s.Verify()
+	catch(err)
+	keys := []string{}
+	for _, m := range bad {
+		keys = append(keys, m.Key)
+	}
+	sort.Strings(keys)
+	assertKeys(t, keys, []string{"a", "b"})
+
+	for _, k := range keys {
+		err := s.Delete(k)
+		catch(err)
+	}
+	assertKeys(t, s.Keys(), []string{"c"})
+	if s.Size() != 3 {
+		t.Fatalf("Expected size 3, got %d", s.Size())
+	}
+}
+
+func TestAudit(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"a", "b", "c"} {
+		catch(s.Put(k, []byte("abc")))
+	}
+
+	// Tamper with the files behind the cache's back, and leave some of its own.
+	catch(os.Remove(filepath.Join(storageDir, "a")))
+	catch(ioutil.WriteFile(filepath.Join(storageDir, "b"), []byte("abcdef"), 0666))
+	catch(ioutil.WriteFile(filepath.Join(storageDir, "d"), []byte("ghi"), 0666))
+
+	for _, prune := range []bool{false, true} {
+		bad, orphans, err := s.Audit(prune)
+		catch(err)
+		keys := []string{}
+		for _, m := range bad {
+			keys = append(keys, m.Key)
+		}
+		sort.Strings(keys)
+		assertKeys(t, keys, []string{"a", "b"})
+		assertKeys(t, orphans, []string{"d"})
+	}
+
+	assertKeys(t, s.Keys(), []string{"c"})
+	if s.Size() != 3 {
+		t.Fatalf("Expected size 3, got %d", s.Size())
+	}
+	for _, name := range []string{"b", "d"} {
+		if _, err := os.Stat(filepath.Join(storageDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted, got %v", name, err)
+		}
+	}
+	bad, orphans, err := s.Audit(false)
+	catch(err)
+	if len(bad) != 0 || len(orphans) != 0 {
+		t.Fatalf("Expected nothing left to report, got %v and %v", bad, orphans)
+	}
+}
+
+func TestGetDeflateClose(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithDeflate(true))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+
+	r, err := s.Get("a")
+	catch(err)
+	f := r.(*DeflateReader).src.(*trackedFile).File
+	err = r.Close()
+	catch(err)
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Expected err == %q, got %q", os.ErrClosed, err)
+	}
+
+	// A codec that fails to return a reader must not leak the file.
+	var src io.ReadCloser
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithCodec(nilCodec{&src}))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+	if _, err := s.Get("a"); err == nil {
+		t.Fatalf("Expected Get to fail")
+	}
+	if _, err := src.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Expected err == %q, got %q", os.ErrClosed, err)
+	}
+}
+
+func TestKeyToPath(t *testing.T) {
+	clearStorage()
+
+	keyToPath := func(k string) string {
+		for len(k) < 4 {
+			k += "_"
+		}
+		return k[:2] + "/" + k[2:4] + "/" + k
+	}
+	opts := []Option{WithMaxSize(2048), WithMaxEntries(40), WithKeyToPath(keyToPath)}
+	s, err := New(storageDir, opts...)
+	catch(err)
+	for k, v := range blobs {
+		err := s.Put(k, v)
+		catch(err)
+	}
+	m, err := s.Stat("gopher")
+	catch(err)
+	if p := filepath.Join(storageDir, "go", "ph", "gopher"); m.Path != p {
+		t.Fatalf("Expected path == %q, got %q", p, m.Path)
+	}
+
+	// Simulate a restart
+	s, err = New(storageDir, opts...)
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+	keys := []string{}
+	for k := range blobs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assertKeys(t, s.Keys(), keys)
+	for k, v := range blobs {
+		b, err := s.GetBytes(k)
+		catch(err)
+		if !bytes.Equal(b, v) {
+			t.Fatalf("Expected %q == %q, got %q", k, v, b)
+		}
+	}
+
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithKeyToPath(func(k string) string {
+		return "../" + k
+	}))
+	catch(err)
+	if err := s.Put("a", []byte("abc")); err != ErrBadKey {
+		t.Fatalf("Expected err == %q, got %q", ErrBadKey, err)
+	}
+}
+
+func TestGetReader(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = s.Put("b", []byte("defg"))
+	catch(err)
+
+	r, m, err := s.GetReader("a", false)
+	catch(err)
+	v, err := ioutil.ReadAll(r)
+	r.Close()
+	catch(err)
+	if !bytes.Equal(v, []byte("abc")) || m.Key != "a" || m.Size != 3 {
+		t.Fatalf("Expected %q of size 3, got %q of size %d", "abc", v, m.Size)
+	}
+
+	// a was not promoted, so it is evicted first.
+	err = s.Put("c", []byte("hij"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "c"})
+
+	r, _, err = s.GetReader("b", true)
+	catch(err)
+	r.Close()
+	err = s.Put("d", []byte("klm"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"b", "d"})
+
+	if _, _, err := s.GetReader("a", true); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"a", "b"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(filepath.Join(storageDir, "a"), old, old)
+	catch(err)
+
+	err = s.StartJanitor(10*time.Millisecond, time.Minute)
+	catch(err)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Has("a") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertKeys(t, s.Keys(), []string{"b"})
+	if n := s.Stats().Evictions; n != 1 {
+		t.Fatalf("Expected 1 eviction(s), got %d", n)
+	}
+
+	err = s.Close()
+	catch(err)
+	if err := s.StartJanitor(10*time.Millisecond, time.Minute); err != ErrClosed {
+		t.Fatalf("Expected err == %q, got %q", ErrClosed, err)
+	}
+
+	// Failures to evict are logged, and left for the next sweep.
+	var lines []string
+	logger := funcLogger(func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithLogger(logger))
+	catch(err)
+	catch(s.Put("c", []byte("abc")))
+	path := filepath.Join(storageDir, "c")
+	catch(os.Remove(path))
+	catch(os.Mkdir(path, 0777))
+	catch(ioutil.WriteFile(filepath.Join(path, "x"), nil, 0666))
+	catch(os.Chtimes(path, old, old))
+	s.sweep(time.Minute)
+	if !s.Has("c") || len(lines) != 1 || !strings.HasPrefix(lines[0], `stash: janitor failed to evict "c": `) {
+		t.Fatalf("Expected c left and the failure logged, got keys %v and lines %q", s.Keys(), lines)
+	}
+}
+
+func TestLastAccess(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	before := time.Now()
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	m, err := s.Stat("a")
+	catch(err)
+	if m.LastAccess.Before(before) {
+		t.Fatalf("Expected last access after %v, got %v", before, m.LastAccess)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	r, _, err := s.GetReader("a", false)
+	catch(err)
+	r.Close()
+	m2, err := s.Stat("a")
+	catch(err)
+	if !m2.LastAccess.Equal(m.LastAccess) {
+		t.Fatalf("Expected last access %v, got %v", m.LastAccess, m2.LastAccess)
+	}
+
+	_, err = s.GetBytes("a")
+	catch(err)
+	err = s.Range(func(m2 Meta) bool {
+		if !m2.LastAccess.After(m.LastAccess) {
+			t.Fatalf("Expected last access after %v, got %v", m.LastAccess, m2.LastAccess)
+		}
+		return true
+	})
+	catch(err)
+}
+
+func TestPutWriter(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithDeflate(deflate), WithVerify(true))
+		catch(err)
+		w, err := s.PutWriter("gopher")
+		catch(err)
+		for _, p := range bytes.SplitAfter(blobs["gopher"], []byte(" ")) {
+			_, err := w.Write(p)
+			catch(err)
+		}
+		if s.Has("gopher") {
+			t.Fatalf("Expected blob to be added on Close only")
+		}
+		err = w.Close()
+		catch(err)
+
+		v, err := s.GetBytes("gopher")
+		catch(err)
+		if !bytes.Equal(v, blobs["gopher"]) {
+			t.Fatalf("Expected v == %q, got %q", blobs["gopher"], v)
+		}
+		m, err := s.Stat("gopher")
+		catch(err)
+		if s.Size() != m.Size {
+			t.Fatalf("Expected size %d, got %d", m.Size, s.Size())
+		}
+	}
+
+	// Writers failing, or outliving the cache, leave nothing behind.
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(8), WithMaxEntries(40))
+	catch(err)
+	w, err := s.PutWriter("a")
+	catch(err)
+	w.Write([]byte("abcdefghi"))
+	if err := w.Close(); err == nil {
+		t.Fatalf("Expected Close to fail")
+	}
+	w, err = s.PutWriter("b")
+	catch(err)
+	_, err = w.Write([]byte("abc"))
+	catch(err)
+	err = s.Close()
+	catch(err)
+	if err := w.Close(); err != ErrClosed {
+		t.Fatalf("Expected err == %q, got %q", ErrClosed, err)
+	}
+	files, err := ioutil.ReadDir(storageDir)
+	catch(err)
+	if len(files) != 0 {
+		t.Fatalf("Expected 0 file(s), got %d", len(files))
+	}
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	clearStorage()
+
+	// Pretend the filesystem has room for 4 files of 10 bytes.
+	defer func(f func(string) (int64, error)) { freeSpace = f }(freeSpace)
+	freeSpace = func(dir string) (int64, error) {
+		files, err := ioutil.ReadDir(dir)
+		return 40 - 10*int64(len(files)), err
+	}
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithMinFreeSpace(15))
+	catch(err)
+	for _, k := range []string{"a", "b", "c"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+	assertKeys(t, s.Keys(), []string{"b", "c"})
+
+	s, err = New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithMinFreeSpace(50))
+	catch(err)
+	err = s.Put("d", []byte("abc"))
+	if err, ok := err.(*FileError); !ok || err.Err != ErrNoSpace {
+		t.Fatalf("Expected err == %q, got %q", ErrNoSpace, err)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40), WithDeflate(deflate))
+		catch(err)
+		err = s.Put("a", []byte("abcdefgh"))
+		catch(err)
+
+		for _, c := range []struct {
+			off, length int64
+			v           string
+		}{
+			{0, 3, "abc"},
+			{2, 4, "cdef"},
+			{5, -1, "fgh"},
+			{6, 10, "gh"},
+			{10, 2, ""},
+		} {
+			r, err := s.GetRange("a", c.off, c.length)
+			catch(err)
+			v, err := ioutil.ReadAll(r)
+			r.Close()
+			catch(err)
+			if string(v) != c.v {
+				t.Fatalf("%d+%d: Expected v == %q, got %q", c.off, c.length, c.v, v)
+			}
+		}
+
+		if _, err := s.GetRange("a", -1, 2); err != ErrBadRange {
+			t.Fatalf("Expected err == %q, got %q", ErrBadRange, err)
+		}
+		if _, err := s.GetRange("b", 0, 2); err != ErrNotFound {
+			t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+		}
+	}
+}
+
+func TestGetEvictRace(t *testing.T) {
+	// Get opens files without the lock; checking and holding them in memory happen outside it too.
+	for _, opts := range [][]Option{nil, {WithVerify(true), WithMemoryTier(64), WithDeflate(true)}} {
+		clearStorage()
+
+		s, err := New(storageDir, append([]Option{WithMaxSize(2048), WithMaxEntries(4)}, opts...)...)
+		catch(err)
+		keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					k := keys[(i+j)%len(keys)]
+					if i%4 == 0 {
+						if err := s.Put(k, []byte(strings.Repeat(k, 16))); err != nil {
+							errs <- err
+							return
+						}
+						continue
+					}
+					r, err := s.Get(k)
+					if err == ErrNotFound {
+						continue
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					v, err := ioutil.ReadAll(r)
+					r.Close()
+					if err != nil {
+						errs <- err
+						return
+					}
+					if string(v) != strings.Repeat(k, 16) {
+						errs <- errors.New("read " + string(v) + " for " + k)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeferUnlink(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	path := filepath.Join(storageDir, "a")
+
+	// Pretend removing the file failed while it was open, as it does on Windows.
+	r, err := s.Get("a")
+	catch(err)
+	if !s.deferUnlink(path) {
+		t.Fatalf("Expected the file to have a reader")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the file to stay while open, got %v", err)
+	}
+	err = r.Close()
+	catch(err)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the file to be removed on close, got %v", err)
+	}
+	if s.deferUnlink(path) {
+		t.Fatalf("Expected the file to have no readers")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, minSize := range []int64{0, -1, 100} { // -1 for no compression
+		deflate := minSize >= 0
+		clearStorage()
+
+		err := os.Mkdir(filepath.Join(storageDir, "src"), 0777)
+		catch(err)
+		src, err := New(filepath.Join(storageDir, "src"), WithMaxSize(2048), WithMaxEntries(40), WithDeflate(deflate), WithDeflateMinSize(minSize))
+		catch(err)
+		for _, k := range []string{"gopher", "io/ioutil", "empty.txt", "null"} {
+			err := src.Put(k, blobs[k])
+			catch(err)
+		}
+		var buf bytes.Buffer
+		err = src.Export(&buf)
+		catch(err)
+
+		// Import into a cache with room for 3 entries only.
+		err = os.Mkdir(filepath.Join(storageDir, "dst"), 0777)
+		catch(err)
+		dst, err := New(filepath.Join(storageDir, "dst"), WithMaxSize(2048), WithMaxEntries(3), WithDeflate(deflate), WithDeflateMinSize(minSize))
+		catch(err)
+		err = dst.Import(&buf)
+		catch(err)
+		assertKeys(t, dst.Keys(), []string{"empty.txt", "io/ioutil", "null"})
+		for _, k := range dst.Keys() {
+			v, err := dst.GetBytes(k)
+			catch(err)
+			if !bytes.Equal(v, blobs[k]) {
+				t.Fatalf("Expected %q == %q, got %q", k, blobs[k], v)
+			}
+			m, err := src.Stat(k)
+			catch(err)
+			n, err := dst.Stat(k)
+			catch(err)
+			if m.Size != n.Size {
+				t.Fatalf("Expected %q of size %d, got %d", k, m.Size, n.Size)
+			}
+		}
+	}
+}
+
+func TestEvictionPlan(t *testing.T) {
+	l := list.New()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		l.PushFront(&Meta{Key: k, Size: 3})
+	}
+
+	for i, c := range []struct {
+		size, cap, n, entries int64
+		keys                  []string
+	}{
+		{size: 20, cap: 10, n: 3, entries: 1, keys: nil},
+		{size: 14, cap: 10, n: 3, entries: 1, keys: []string{"a"}},
+		{size: 12, cap: 10, n: 7, entries: 1, keys: []string{"a", "b", "c"}},
+		{size: 20, cap: 4, n: 3, entries: 1, keys: []string{"a"}},
+		{size: 20, cap: 2, n: 0, entries: 0, keys: []string{"a", "b"}},
+		{size: 2, cap: 10, n: 3, entries: 1, keys: []string{"a", "b", "c", "d"}},
+	} {
+		keys := evictionPlan(l, func(m *Meta) int64 { return m.Size }, 12, 4, c.size, c.cap, c.n, c.entries)
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Fatalf("#%d: Expected keys == %q, got %q", i+1, c.keys, keys)
+		}
+	}
+	if l.Len() != 4 {
+		t.Fatalf("Expected list to be left alone, got %d entries", l.Len())
+	}
+
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(8), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"a", "b"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+	keys := s.EvictionPlan(5)
+	if !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Fatalf("Expected keys == %q, got %q", []string{"a"}, keys)
+	}
+	assertKeys(t, s.Keys(), []string{"a", "b"})
+}
+
+func TestPutEx(t *testing.T) {
+	clearStorage()
+
+	var hooked []string
+	s, err := New(storageDir, WithMaxSize(9), WithMaxEntries(40), WithOnEvict(func(key string, size int64) {
+		hooked = append(hooked, key)
+	}))
+	catch(err)
+	for _, k := range []string{"a/1", "b/2", "c/3"} {
+		evicted, err := s.PutEx(k, []byte("abc"))
+		catch(err)
+		if len(evicted) != 0 {
+			t.Fatalf("Expected no evictions, got %q", evicted)
+		}
+	}
+
+	evicted, err := s.PutEx("d/4", []byte("defghi"))
+	catch(err)
+	if !reflect.DeepEqual(evicted, []string{"a/1", "b/2"}) {
+		t.Fatalf("Expected evicted == %q, got %q", []string{"a/1", "b/2"}, evicted)
+	}
+	if !reflect.DeepEqual(hooked, evicted) {
+		t.Fatalf("Expected hook to see %q, got %q", evicted, hooked)
+	}
+}
+
+func TestBadAccounting(t *testing.T) {
+	clearStorage()
+
+	var lines []string
+	logger := funcLogger(func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+	s, err := New(storageDir, WithMaxSize(9), WithMaxEntries(40), WithLogger(logger))
+	catch(err)
+	for _, k := range []string{"a", "b", "c"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+
+	// Corrupt the accounting, as if the size of a had been mis-recorded.
+	s.m[escape("a")].Value.(*Meta).Size = 100
+
+	// The drift is logged, and does not fail the put that found it.
+	err = s.Put("d", []byte("def"))
+	catch(err)
+	if s.Size() < 0 {
+		t.Fatalf("Expected size to stay non-negative, got %d", s.Size())
+	}
+	assertKeys(t, s.Keys(), []string{"b", "c", "d"})
+	if len(lines) != 2 || lines[0] != `stash: size accounting went below zero dropping "a"; reset to zero` {
+		t.Fatalf("Expected the drift logged, got lines %q", lines)
+	}
+	if _, err := s.Verify(); err != ErrBadAccounting {
+		t.Fatalf("Expected err == %q, got %q", ErrBadAccounting, err)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	ops := []SimOp{{"a", 4}, {"b", 4}, {"a", 4}, {"c", 4}, {"b", 4}, {"a", 4}, {"x", 20}}
+
+	r := Simulate(10, 2, ops)
+	if want := (SimResult{Hits: 1, Misses: 6, Evictions: 3, Rejected: 1}); r != want {
+		t.Fatalf("Expected %+v, got %+v", want, r)
+	}
+	r = Simulate(10, 2, ops, WithPolicy(FIFO))
+	if want := (SimResult{Hits: 2, Misses: 5, Evictions: 2, Rejected: 1}); r != want {
+		t.Fatalf("Expected %+v, got %+v", want, r)
+	}
+	if r.HitRate() != 2.0/7 {
+		t.Fatalf("Expected hit rate %v, got %v", 2.0/7, r.HitRate())
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	words := []string{"stash", "cache", "blob", "disk", "lz4", "level", "entry", "key"}
+	r := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for buf.Len() < 1<<16 {
+		buf.WriteString(words[r.Intn(len(words))])
+		buf.WriteByte(' ')
+	}
+	val := buf.Bytes()
+
+	var sizes []int64
+	for _, level := range []int{0, 1 << 16} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true), WithCompressionLevel(level))
+		catch(err)
+		err = s.Put("a", val)
+		catch(err)
+		b, err := s.GetBytes("a")
+		catch(err)
+		if !bytes.Equal(b, val) {
+			t.Fatalf("Expected blob to round-trip at level %d", level)
+		}
+		sizes = append(sizes, s.Size())
+	}
+	if sizes[1] >= sizes[0] {
+		t.Fatalf("Expected higher level to compress better, got sizes %v", sizes)
+	}
+}
+
+type funcLogger func(format string, v ...interface{})
+
+func (f funcLogger) Printf(format string, v ...interface{}) { f(format, v...) }
+
+func TestLogger(t *testing.T) {
+	clearStorage()
+
+	var s *Cache
+	var lines []string
+	logger := funcLogger(func(format string, v ...interface{}) {
+		s.Len() // Deadlocks if called with the lock held.
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+
+	s, err := New(storageDir, WithMaxSize(6), WithMaxEntries(40), WithLogger(logger))
+	catch(err)
+	for _, k := range []string{"a", "b", "c"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+	err = s.Put("d", []byte("abcdefgh"))
+	if err, ok := err.(*FileError); !ok || err.Err != ErrTooLarge {
+		t.Fatalf("Expected err == %q, got %q", ErrTooLarge, err)
+	}
+	os.Remove(filepath.Join(storageDir, "c"))
+	if _, err := s.Get("c"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+
+	want := []string{
+		`stash: evicted "a" (3 bytes)`,
+		`stash: rejected "d": ` + (&FileError{storageDir, "d", ErrTooLarge}).Error(),
+		`stash: dropped "c": file is gone`,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("Expected lines %q, got %q", want, lines)
+	}
+}
+
+func TestKeyCollision(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithKeyToPath(strings.ToLower))
+	catch(err)
+	err = s.Put("A", []byte("abc"))
+	catch(err)
+
+	for _, put := range []func() error{
+		func() error { return s.Put("a", []byte("def")) },
+		func() error { return s.PutEphemeral("a", []byte("def")) },
+	} {
+		if err := put(); err != ErrKeyCollision {
+			t.Fatalf("Expected err == %q, got %q", ErrKeyCollision, err)
+		}
+	}
+	b, err := s.GetBytes("A")
+	catch(err)
+	if string(b) != "abc" {
+		t.Fatalf("Expected blob of A to be intact, got %q", b)
+	}
+
+	err = s.Delete("A")
+	catch(err)
+	err = s.Put("a", []byte("def"))
+	catch(err)
+	assertKeys(t, s.Keys(), []string{"a"})
+}
+
+func TestFS(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(deflate))
+		catch(err)
+		err = s.Put("a", []byte("abc"))
+		catch(err)
+		err = s.Put("b", []byte("def"))
+		catch(err)
+		err = s.Put("c/d", []byte("ghi"))
+		catch(err)
+
+		fsys := s.FS()
+		b, err := fs.ReadFile(fsys, "c/d")
+		catch(err)
+		if string(b) != "ghi" {
+			t.Fatalf("deflate=%v: Expected %q, got %q", deflate, "ghi", b)
+		}
+		fi, err := fs.Stat(fsys, "a")
+		catch(err)
+		if fi.Size() != 3 {
+			t.Fatalf("deflate=%v: Expected size 3, got %d", deflate, fi.Size())
+		}
+		catch(fstest.TestFS(fsys, "a", "b"))
+		if _, err := fsys.Open("e"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("deflate=%v: Expected err == %q, got %q", deflate, fs.ErrNotExist, err)
+		}
+		entries, err := fs.ReadDir(fsys, ".")
+		catch(err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		assertKeys(t, names, []string{"a", "b"})
+
+		w := httptest.NewRecorder()
+		http.FileServer(http.FS(fsys)).ServeHTTP(w, httptest.NewRequest("GET", "/b", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "def" || w.Header().Get("Content-Length") != "3" {
+			t.Fatalf("deflate=%v: Expected 200 %q of length 3, got %d %q of length %s", deflate, "def", w.Code, w.Body, w.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestGetStringJSON(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte(`{"n":1,"s":"abc"}`))
+	catch(err)
+
+	str, err := s.GetString("a")
+	catch(err)
+	if str != `{"n":1,"s":"abc"}` {
+		t.Fatalf("Expected %q, got %q", `{"n":1,"s":"abc"}`, str)
+	}
+	var v struct {
+		N int
+		S string
+	}
+	err = s.GetJSON("a", &v)
+	catch(err)
+	if v.N != 1 || v.S != "abc" {
+		t.Fatalf("Expected {1 abc}, got %v", v)
+	}
+	if _, err := s.GetString("b"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+	if err := s.GetJSON("b", &v); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+}
+
+func TestCapDrain(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(5))
+	catch(err)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+		time.Sleep(10 * time.Millisecond) // Keep the modification times apart for Warmup.
+	}
+
+	// Adopt the files into a cache of a lower cap, leaving it over capacity.
+	s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(2))
+	catch(err)
+	err = s.Warmup()
+	catch(err)
+	err = s.Put("f", []byte("abc"))
+	catch(err)
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Expected Len() == 2, got %d", n)
+	}
+	assertKeys(t, s.Keys(), []string{"e", "f"})
+}
+
+func TestLogicalSize(t *testing.T) {
+	val := bytes.Repeat([]byte("a"), 1000)
+
+	for _, logical := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2500), WithMaxEntries(40), WithDeflate(true), WithLogicalSize(logical))
+		catch(err)
+		for _, k := range []string{"a", "b", "c"} {
+			err := s.Put(k, val)
+			catch(err)
+		}
+
+		st := s.Stats()
+		if logical {
+			assertKeys(t, s.Keys(), []string{"b", "c"})
+			if st.LogicalUsed != 2000 {
+				t.Fatalf("Expected LogicalUsed == 2000, got %d", st.LogicalUsed)
+			}
+		} else {
+			assertKeys(t, s.Keys(), []string{"a", "b", "c"})
+			if st.LogicalUsed != 3000 {
+				t.Fatalf("Expected LogicalUsed == 3000, got %d", st.LogicalUsed)
+			}
+		}
+		if st.DiskUsed != s.Size() || st.DiskUsed >= st.LogicalUsed {
+			t.Fatalf("logical=%v: Expected DiskUsed == %d < %d, got %d", logical, s.Size(), st.LogicalUsed, st.DiskUsed)
+		}
+	}
+}
+
+func TestGetReaderAt(t *testing.T) {
+	for _, opt := range []Option{WithMemoryTier(0), WithMemoryTier(1024)} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), opt)
+		catch(err)
+		err = s.Put("a", []byte("abcdefgh"))
+		catch(err)
+		s.GetBytes("a") // Pulls the blob into the memory tier, if any.
+
+		r, n, err := s.GetReaderAt("a")
+		catch(err)
+		if n != 8 {
+			t.Fatalf("Expected size 8, got %d", n)
+		}
+		p := make([]byte, 3)
+		_, err = r.ReadAt(p, 4)
+		catch(err)
+		if string(p) != "efg" {
+			t.Fatalf("Expected %q, got %q", "efg", p)
+		}
+		err = r.Close()
+		catch(err)
+		if _, _, err := s.GetReaderAt("b"); err != ErrNotFound {
+			t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+		}
+	}
+
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true))
+	catch(err)
+	err = s.Put("a", []byte("abcdefgh"))
+	catch(err)
+	if _, _, err := s.GetReaderAt("a"); err != ErrNoRandomAccess {
+		t.Fatalf("Expected err == %q, got %q", ErrNoRandomAccess, err)
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if r, err := s.Get("a"); err == nil {
+					r.Close()
+				}
+				s.Get("b")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				st := s.Stats()
+				if st.Hits < 0 || st.Misses < 0 || st.DiskUsed != 3 {
+					t.Errorf("Unexpected stats %+v", st)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if st := s.Stats(); st.Hits != 4*n || st.Misses != 4*n {
+		t.Fatalf("Expected %d hits and misses, got %+v", 4*n, st)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithFileMode(0600), WithDirMode(0700), WithKeyToPath(func(k string) string { return "d/" + k }))
+	catch(err)
+	err = s.Put("a", []byte("abc"))
+	catch(err)
+	err = ioutil.WriteFile("putfile", []byte("def"), 0644)
+	catch(err)
+	defer os.Remove("putfile")
+	err = s.PutFile("b", "putfile")
+	catch(err)
+
+	for name, mode := range map[string]os.FileMode{"d": os.ModeDir | 0700, "d/a": 0600, "d/b": 0600, namesFile: 0600} {
+		fi, err := os.Stat(filepath.Join(storageDir, name))
+		catch(err)
+		if fi.Mode() != mode {
+			t.Fatalf("Expected mode of %s == %v, got %v", name, mode, fi.Mode())
+		}
+	}
+}
+
+func TestKeysByRecency(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"b", "a", "c"} {
+		err := s.Put(k, []byte("abc"))
+		catch(err)
+	}
+	r, err := s.Get("b")
+	catch(err)
+	r.Close()
+
+	assertKeys(t, s.KeysByRecency(), []string{"b", "c", "a"})
+	assertKeys(t, s.Keys(), []string{"a", "b", "c"})
+}
+
+func TestDeflateMinSize(t *testing.T) {
+	clearStorage()
+
+	small := []byte("abcdefgh")
+	large := bytes.Repeat([]byte("a"), 1000)
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(true), WithDeflateMinSize(64))
+	catch(err)
+	put := map[string]func(key string, val []byte) error{
+		"put": s.Put,
+		"reader": func(key string, val []byte) error {
+			return s.PutReader(key, bytes.NewReader(val))
+		},
+		"writer": func(key string, val []byte) error {
+			w, err := s.PutWriter(key)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < len(val); i += 10 { // Cross the threshold partway.
+				j := i + 10
+				if j > len(val) {
+					j = len(val)
+				}
+				if _, err := w.Write(val[i:j]); err != nil {
+					return err
+				}
+			}
+			return w.Close()
+		},
+	}
+	for name, fn := range put {
+		for _, val := range [][]byte{small, large} {
+			k := fmt.Sprintf("%s%d", name, len(val))
+			catch(fn(k, val))
+
+			m, err := s.Stat(k)
+			catch(err)
+			if compressed := len(val) >= 64; m.Compressed != compressed {
+				t.Fatalf("Expected %s Compressed == %v, got %v", k, compressed, m.Compressed)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(storageDir, k))
+			catch(err)
+			if m.Compressed == bytes.Equal(b, val) {
+				t.Fatalf("Expected %s stored compressed == %v, got %q", k, m.Compressed, b)
+			}
+			v, err := s.GetBytes(k)
+			catch(err)
+			if !bytes.Equal(v, val) {
+				t.Fatalf("Expected %s == %q, got %q", k, val, v)
+			}
+		}
+	}
+}
+
+func TestMixedCompression(t *testing.T) {
+	clearStorage()
+
+	a := bytes.Repeat([]byte("a"), 1000)
+	b := bytes.Repeat([]byte("b"), 1000)
+	check := func(s *Cache, want map[string][]byte) {
+		for k, val := range want {
+			v, err := s.GetBytes(k)
+			catch(err)
+			if !bytes.Equal(v, val) {
+				t.Fatalf("Expected %s == %q, got %q", k, val, v)
+			}
+		}
+	}
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithIndex(true), WithDeflate(true))
+	catch(err)
+	catch(s.Put("a", a))
+	catch(s.Close())
+
+	s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithIndex(true))
+	catch(err)
+	catch(s.Put("b", b))
+	if m, _ := s.Stat("a"); !m.Compressed {
+		t.Fatalf("Expected a to stay compressed")
+	}
+	if m, _ := s.Stat("b"); m.Compressed {
+		t.Fatalf("Expected b to be stored uncompressed")
+	}
+	check(s, map[string][]byte{"a": a, "b": b})
+	catch(s.Append("a", []byte("xyz")))
+	a = append(a, "xyz"...)
+	check(s, map[string][]byte{"a": a, "b": b})
+	catch(s.Close())
+
+	s, err = New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithIndex(true), WithDeflate(true))
+	catch(err)
+	check(s, map[string][]byte{"a": a, "b": b})
+	catch(s.Close())
+}
+
+func TestTouch(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	catch(s.Put("a", []byte("1")))
+	catch(s.Put("b", []byte("2")))
+	before, err := s.Stat("a")
+	catch(err)
+	time.Sleep(10 * time.Millisecond)
+
+	catch(s.Touch("a"))
+	after, err := s.Stat("a")
+	catch(err)
+	if !after.LastAccess.After(before.LastAccess) {
+		t.Fatalf("Expected LastAccess to advance past %v, got %v", before.LastAccess, after.LastAccess)
+	}
+	catch(s.Put("c", []byte("3"))) // Evicts b rather than a.
+	if !s.Has("a") || s.Has("b") {
+		t.Fatalf("Expected a to survive and b to be evicted, got keys %v", s.Keys())
+	}
+	if err := s.Touch("b"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if s := s.Stats(); s.Hits != 0 || s.Misses != 0 {
+		t.Fatalf("Expected no hits or misses, got %+v", s)
+	}
+}
+
+func TestKeysWithPrefix(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	for _, k := range []string{"images/b.png", "images/a.png", "imagesx", "docs/a.txt", "images%2Fc"} {
+		catch(s.Put(k, []byte(k)))
+	}
+
+	keys := s.KeysWithPrefix("images/")
+	if want := []string{"images/a.png", "images/b.png"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Expected %v, got %v", want, keys)
+	}
+	if keys := s.KeysWithPrefix("none/"); len(keys) != 0 {
+		t.Fatalf("Expected no keys, got %v", keys)
+	}
+	if keys := s.KeysWithPrefix(""); !reflect.DeepEqual(keys, s.Keys()) {
+		t.Fatalf("Expected %v, got %v", s.Keys(), keys)
+	}
+}
+
+func TestEvictStuckFile(t *testing.T) {
+	clearStorage()
+
+	var lines []string
+	logger := funcLogger(func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2), WithLogger(logger))
+	catch(err)
+	catch(s.Put("a", []byte("1")))
+	catch(s.Put("b", []byte("2")))
+
+	// A non-empty directory cannot be removed, even with permission to.
+	path := filepath.Join(storageDir, "a")
+	catch(os.Remove(path))
+	catch(os.Mkdir(path, 0777))
+	catch(ioutil.WriteFile(filepath.Join(path, "x"), nil, 0666))
+
+	catch(s.Put("c", []byte("3")))
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Fatalf("Expected keys [a c], got %v", keys)
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `stash: skipped evicting "a": `) || lines[1] != `stash: evicted "b" (1 bytes)` {
+		t.Fatalf("Expected a skipped and b evicted, got lines %q", lines)
+	}
+	if plan := s.EvictionPlan(1); !reflect.DeepEqual(plan, []string{"c"}) {
+		t.Fatalf("Expected plan [c] past stuck a, got %v", plan)
+	}
+
+	n, err := s.TrimToSize(0)
+	if err, ok := err.(*EvictError); !ok || len(err.Errs) != 1 || err.Errs["a"] == nil {
+		t.Fatalf("Expected an EvictError for a, got %v", err)
+	}
+	if n != 1 || s.Len() != 1 || !s.Has("a") {
+		t.Fatalf("Expected c evicted and a left, got %d evicted and keys %v", n, s.Keys())
+	}
+
+	// Once the file can be removed, the next eviction tries again.
+	catch(os.Remove(filepath.Join(path, "x")))
+	n, err = s.TrimToSize(0)
+	catch(err)
+	if n != 1 || s.Len() != 0 {
+		t.Fatalf("Expected a evicted, got %d evicted and keys %v", n, s.Keys())
+	}
+}
+
+func TestPutContent(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2))
+	catch(err)
+	a, err := s.PutContent([]byte("abc"))
+	catch(err)
+	if want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; a != want {
+		t.Fatalf("Expected key %q, got %q", want, a)
+	}
+	b, err := s.PutContent([]byte("def"))
+	catch(err)
+
+	again, err := s.PutContent([]byte("abc")) // Promotes a over b.
+	catch(err)
+	if again != a || s.Len() != 2 {
+		t.Fatalf("Expected key %q and 2 entries, got %q and %d", a, again, s.Len())
+	}
+	_, err = s.PutContent([]byte("ghi"))
+	catch(err)
+	if !s.Has(a) || s.Has(b) {
+		t.Fatalf("Expected %s to survive and %s to be evicted, got keys %v", a, b, s.Keys())
+	}
+	v, err := s.GetBytes(a)
+	catch(err)
+	if string(v) != "abc" {
+		t.Fatalf("Expected v == %q, got %q", "abc", v)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	value := bytes.Repeat([]byte("abc"), 1000)
+
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(deflate))
+		catch(err)
+		catch(s.Put("key", value))
+
+		var buf bytes.Buffer
+		n, err := s.WriteTo("key", &buf)
+		catch(err)
+		if n != int64(len(value)) || !bytes.Equal(buf.Bytes(), value) {
+			t.Fatalf("Expected %d bytes written, got %d of %q", len(value), n, buf.Bytes())
+		}
+		if _, err := s.WriteTo("none", &buf); err != ErrNotFound {
+			t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+		}
+		if len(s.readers) != 0 {
+			t.Fatalf("Expected no open files, got %v", s.readers)
+		}
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	clearStorage()
+
+	tmp, err := ioutil.TempDir("", "stash-tmp")
+	catch(err)
+	defer os.RemoveAll(tmp)
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithTempDir(tmp))
+	catch(err)
+	catch(s.Put("a", []byte("abc")))
+
+	w, err := s.PutWriter("b")
+	catch(err)
+	_, err = w.Write([]byte("def"))
+	catch(err)
+	if fis, _ := ioutil.ReadDir(tmp); len(fis) != 1 {
+		t.Fatalf("Expected the blob being written in %s, got %d files", tmp, len(fis))
+	}
+	catch(w.Close())
+
+	if fis, _ := ioutil.ReadDir(tmp); len(fis) != 0 {
+		t.Fatalf("Expected no files left in %s, got %d", tmp, len(fis))
+	}
+	for k, want := range map[string]string{"a": "abc", "b": "def"} {
+		v, err := ioutil.ReadFile(filepath.Join(storageDir, k))
+		catch(err)
+		if string(v) != want {
+			t.Fatalf("Expected %s == %q, got %q", k, want, v)
+		}
+	}
+}
+
+func TestDeflateEnabled(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		clearStorage()
+
+		s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithDeflate(deflate), WithDeflateMinSize(64))
+		catch(err)
+		if s.Deflate() != deflate {
+			t.Fatalf("Expected Deflate() == %v, got %v", deflate, s.Deflate())
+		}
+		catch(s.Put("small", []byte("abc")))
+		catch(s.Put("large", bytes.Repeat([]byte("abc"), 100)))
+		for k, want := range map[string]bool{"small": false, "large": deflate} {
+			m, err := s.Stat(k)
+			catch(err)
+			if m.Compressed != want {
+				t.Fatalf("Expected %s Compressed == %v, got %v", k, want, m.Compressed)
+			}
+		}
+	}
+}
+
+type countMetrics struct {
+	hits, misses, evictions int64
+	sizes                   []int64
+}
+
+func (m *countMetrics) IncHit()                   { m.hits++ }
+func (m *countMetrics) IncMiss()                  { m.misses++ }
+func (m *countMetrics) IncEviction()              { m.evictions++ }
+func (m *countMetrics) ObservePutSize(size int64) { m.sizes = append(m.sizes, size) }
+
+func TestMetrics(t *testing.T) {
+	clearStorage()
+
+	m := &countMetrics{}
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(2), WithMetrics(m))
+	catch(err)
+	catch(s.Put("a", []byte("1")))
+	catch(s.Put("b", []byte("22")))
+	catch(s.Put("c", []byte("333")))
+	_, err = s.GetBytes("c")
+	catch(err)
+	if _, err := s.GetBytes("a"); err != ErrNotFound {
+		t.Fatalf("Expected err == %q, got %q", ErrNotFound, err)
+	}
+
+	if m.hits != 1 || m.misses != 1 || m.evictions != 1 || !reflect.DeepEqual(m.sizes, []int64{1, 2, 3}) {
+		t.Fatalf("Expected 1 hit, 1 miss, 1 eviction and sizes [1 2 3], got %+v", *m)
+	}
+	st := s.Stats()
+	if st.Hits != m.hits || st.Misses != m.misses || st.Evictions != m.evictions || st.Puts != int64(len(m.sizes)) {
+		t.Fatalf("Expected Stats to agree with %+v, got %+v", *m, st)
+	}
+}
+
+func TestGetRaceRename(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048000), WithMaxEntries(40), WithVerify(true))
+	catch(err)
+	catch(s.Put("a", []byte("abc")))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, k := range []string{"a", "b"} {
+					if r, err := s.Get(k); err == nil {
+						r.Close()
+					} else if err != ErrNotFound {
+						t.Errorf("Expected no error but ErrNotFound, got %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20000; i++ {
+		if i%2 == 0 {
+			catch(s.Rename("a", "b"))
+		} else {
+			catch(s.Rename("b", "a"))
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if s.Len() != 1 || !s.Has("a") {
+		t.Fatalf("Expected only a left, got keys %v", s.Keys())
+	}
+	v, err := s.GetBytes("a")
+	catch(err)
+	if string(v) != "abc" {
+		t.Fatalf("Expected v == %q, got %q", "abc", v)
+	}
+}
+
+func TestCompactLayoutPutWriter(t *testing.T) {
+	clearStorage()
+
+	s, err := New(storageDir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	catch(s.Put("a", []byte("abc")))
+	w, err := s.PutWriter("b")
+	catch(err)
+	_, err = w.Write([]byte("def"))
+	catch(err)
+
+	catch(s.CompactLayout())
+	_, err = w.Write([]byte("ghi"))
+	catch(err)
+	catch(w.Close())
+
+	for k, want := range map[string]string{"a": "abc", "b": "defghi"} {
+		v, err := s.GetString(k)
+		catch(err)
+		if v != want {
+			t.Fatalf("Expected %s == %q, got %q", k, want, v)
+		}
+	}
+}
+
+func TestLFUOrder(t *testing.T) {
+	// ref orders keys as LFU should: by frequency, most frequent in front, and by recency among equally frequent ones.
+	var ref []string
+	freq := map[string]int{}
+	touch := func(k string) {
+		for i, r := range ref {
+			if r == k {
+				ref = append(ref[:i], ref[i+1:]...)
+				break
+			}
+		}
+		i := 0
+		for i < len(ref) && freq[ref[i]] > freq[k] {
+			i++
+		}
+		ref = append(ref[:i], append([]string{k}, ref[i:]...)...)
+	}
+
+	l := list.New()
+	m := map[string]*list.Element{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		k := strconv.Itoa(rng.Intn(20))
+		e, ok := m[k]
+		switch {
+		case !ok:
+			m[k] = LFU.Add(l, &Meta{Key: k})
+			freq[k] = 1
+			touch(k)
+		case rng.Intn(4) == 0:
+			removeElement(LFU, l, e)
+			delete(m, k)
+			for j, r := range ref {
+				if r == k {
+					ref = append(ref[:j], ref[j+1:]...)
+					break
+				}
+			}
+		default:
+			LFU.Touch(l, e)
+			freq[k]++
+			touch(k)
+		}
+
+		var keys []string
+		for e := l.Front(); e != nil; e = e.Next() {
+			keys = append(keys, e.Value.(*Meta).Key)
+		}
+		if !reflect.DeepEqual(keys, ref) {
+			t.Fatalf("Expected order %v after %d ops, got %v", ref, i+1, keys)
+		}
+	}
+}
+
+func TestCompactLayoutRecover(t *testing.T) {
+	clearStorage()
+
+	dir := filepath.Join(storageDir, "c")
+	tmp := dir + ".compact-1"
+	s, err := New(dir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	catch(s.Put("a", []byte("abc")))
+	catch(s.Close())
+
+	// Crash between the renames of the swap: the storage directory is missing.
+	catch(os.Rename(dir, tmp))
+	catch(os.Mkdir(tmp+".old", 0777))
+	s, err = New(dir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	catch(s.Warmup())
+	if v, err := s.GetString("a"); err != nil || v != "abc" {
+		t.Fatalf("Expected a == %q, got %q and %v", "abc", v, err)
+	}
+	catch(s.Close())
+
+	// Crash before the swap, with a namespace moved over already.
+	ns := namespacePrefix + "x"
+	catch(os.MkdirAll(filepath.Join(tmp, ns), 0777))
+	catch(ioutil.WriteFile(filepath.Join(tmp, ns, "b"), []byte("def"), 0666))
+	_, err = New(dir, WithMaxSize(2048), WithMaxEntries(40))
+	catch(err)
+	if v, err := ioutil.ReadFile(filepath.Join(dir, ns, "b")); err != nil || string(v) != "def" {
+		t.Fatalf("Expected namespace file back in place, got %q and %v", v, err)
+	}
+	for _, name := range []string{tmp, tmp + ".old"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+}
+
+func TestShardedClose(t *testing.T) {
+	clearStorage()
+
+	s, err := NewSharded(storageDir, 4, WithMaxSize(2048000), WithMaxEntries(40), WithIndex(true))
+	catch(err)
+	for k, b := range blobs {
+		catch(s.Put(k, b))
+	}
+	catch(s.Close())
+	if err := s.Put("a", []byte("abc")); err != ErrClosed {
+		t.Fatalf("Expected err == %q, got %q", ErrClosed, err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := os.Stat(filepath.Join(storageDir, fmt.Sprintf("%02x", i), indexFile)); err != nil {
+			t.Fatalf("Expected an index file in shard %d, got %v", i, err)
+		}
+	}
+
+	s, err = NewSharded(storageDir, 4, WithMaxSize(2048000), WithMaxEntries(40), WithIndex(true))
+	catch(err)
+	if n := s.Len(); n != int64(len(blobs)) {
+		t.Fatalf("Expected Len() == %d, got %d", len(blobs), n)
+	}
+	catch(s.Close())
+}
+
+func TestMain(m *testing.M) {
+	// Create a temporary storage directory for tests
+	name, err := ioutil.TempDir("", "stash-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	storageDir = name
+	defer os.RemoveAll(name)
+
+	os.Exit(m.Run())
+}
+
+func assertKeys(t *testing.T, keys []string, expected []string) {
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d key(s), got %d", len(expected), len(keys))
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected keys == %q, got %q", expected, keys)
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// xorCodec is a trivial Codec that flips every bit.
+type xorCodec struct{}
+
+func (xorCodec) NewReader(r io.ReadCloser) io.ReadCloser {
+	return xorReader{r}
+}
+
+func (xorCodec) NewWriter(w io.WriteCloser) io.WriteCloser {
+	return xorWriter{w}
+}
+
+type xorReader struct {
+	io.ReadCloser
+}
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.ReadCloser.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0xff
+	}
+	return n, err
+}
+
+type xorWriter struct {
+	io.WriteCloser
+}
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	q := make([]byte, len(p))
+	for i := range p {
+		q[i] = p[i] ^ 0xff
+	}
+	return x.WriteCloser.Write(q)
+}
+
+// nilCodec is a Codec that fails to return a reader, keeping the source it was given in src.
+type nilCodec struct {
+	src *io.ReadCloser
+}
+
+func (n nilCodec) NewReader(r io.ReadCloser) io.ReadCloser {
+	*n.src = r
+	return nil
+}
+
+func (nilCodec) NewWriter(w io.WriteCloser) io.WriteCloser {
+	return w
+}
+
+// failCodec is a Codec that stores blobs as they are, but fails writing partway through while fail is set.
+type failCodec struct {
+	fail *error
+}
+
+func (failCodec) NewReader(r io.ReadCloser) io.ReadCloser {
+	return r
+}
+
+func (f failCodec) NewWriter(w io.WriteCloser) io.WriteCloser {
+	return failWriter{w, f.fail}
+}
+
+type failWriter struct {
+	io.WriteCloser
+	fail *error
+}
+
+func (f failWriter) Write(p []byte) (int, error) {
+	if err := *f.fail; err != nil && len(p) > 1 {
+		*f.fail = nil
+		n, _ := f.WriteCloser.Write(p[:1])
+		return n, err
 	}
+	return f.WriteCloser.Write(p)
 }
 
 func catch(err error) {
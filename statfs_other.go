@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package stash
+
+// statfsFree returns -1, as the free space of filesystems is not known on this platform.
+func statfsFree(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,27 @@
+package stash
+
+import "sync/atomic"
+
+// Stats holds counters describing the effectiveness of a Cache, along with how much it holds.
+type Stats struct {
+	Hits      int64 // Number of Get calls that found the blob
+	Misses    int64 // Number of Get calls that did not find the blob
+	Evictions int64 // Number of blobs removed to make room for others
+	Puts      int64 // Number of blobs added
+
+	DiskUsed    int64 // Total size of the files of blobs on disk, as reported by Size
+	LogicalUsed int64 // Total size of blobs before compression, counting compressed blobs of unknown size as their files
+}
+
+// Stats returns the counters of the cache. It does not take the lock of the cache, so it never waits for other operations.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadInt64(&c.stats.Hits),
+		Misses:    atomic.LoadInt64(&c.stats.Misses),
+		Evictions: atomic.LoadInt64(&c.stats.Evictions),
+		Puts:      atomic.LoadInt64(&c.stats.Puts),
+
+		DiskUsed:    atomic.LoadInt64(&c.sizeUsed),
+		LogicalUsed: atomic.LoadInt64(&c.lengthUsed),
+	}
+}
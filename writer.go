@@ -0,0 +1,195 @@
+package stash
+
+import (
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PutWriter returns a writer that adds what is written to it as a blob to the cache against the given key. The blob is streamed to a temporary file, and only enters the cache, evicting other entries as needed, once the writer is closed. If writing or closing fails, the temporary file is discarded; so it is if the cache is closed first.
+func (c *Cache) PutWriter(key string) (io.WriteCloser, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	if err := c.checkWriteOnce(key); err != nil {
+		return nil, err
+	}
+	if _, err := c.filename(key); err != nil {
+		return nil, err
+	}
+
+	dir := c.dir
+	if c.tempDir != "" {
+		dir = c.tempDir
+	}
+	f, err := ioutil.TempFile(dir, tempPrefix+"*")
+	if err != nil {
+		return nil, &FileError{c.dir, key, err}
+	}
+	w := &putWriter{
+		c:     c,
+		key:   key,
+		f:     f,
+		lw:    &limitedWriter{f, c.maxEntrySize()},
+		limit: c.maxEntrySize(),
+		h:     crc32.NewIEEE(),
+	}
+	if c.codec == nil || c.minDeflate <= 0 {
+		w.start(c.codec) // Otherwise, whether to compress is only known once minDeflate bytes are written.
+	}
+
+	if c.writers == nil {
+		c.writers = make(map[*putWriter]bool)
+	}
+	c.writers[w] = true
+	return w, nil
+}
+
+// putWriter is the writer returned by PutWriter.
+type putWriter struct {
+	c   *Cache
+	key string
+
+	f     *os.File       // Temporary file
+	lw    *limitedWriter // Limit on the size of f
+	limit int64          // Limit lw started with
+	w     io.WriteCloser // Writer to lw, compressing if needed, nil until decided
+	h     hash.Hash32    // CRC-32 of the blob before compression
+
+	head       []byte // Bytes written before w was decided
+	length     int64  // Bytes written, before compression
+	compressed bool   // Whether w compresses
+
+	err    error // First error writing, which fails Close
+	closed bool
+}
+
+func (w *putWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, &FileError{w.c.dir, w.key, os.ErrClosed}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.w == nil {
+		w.head = append(w.head, p...)
+		w.h.Write(p)
+		w.length += int64(len(p))
+		if !w.c.compresses(w.length) {
+			return len(p), nil
+		}
+		if err := w.start(w.c.codec); err != nil {
+			w.err = &FileError{w.c.dir, w.key, err}
+			return len(p), w.err
+		}
+		return len(p), nil
+	}
+
+	n, err := w.w.Write(p)
+	w.h.Write(p[:n])
+	w.length += int64(n)
+	if err != nil {
+		w.err = &FileError{w.c.dir, w.key, err}
+		return n, w.err
+	}
+	return n, nil
+}
+
+// start sets up w to write to the file, compressing by codec unless nil, and writes the bytes held back so far.
+func (w *putWriter) start(codec Codec) error {
+	w.w = nopCloser{w.lw}
+	if codec != nil {
+		w.w = codec.NewWriter(nopCloser{w.lw})
+	}
+	w.compressed = codec != nil
+	_, err := w.w.Write(w.head)
+	w.head = nil
+	return err
+}
+
+// Close adds the blob written so far to the cache, unless writing failed. Closing again does nothing.
+func (w *putWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	var err error
+	if w.w == nil {
+		err = w.start(nil) // Too small to compress.
+	}
+	if cerr := w.w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		err = &FileError{w.c.dir, w.key, err}
+	}
+	if w.err != nil {
+		err = w.err
+	}
+	err = w.c.commit(w, err)
+	if err != nil {
+		os.Remove(w.f.Name())
+	}
+	return err
+}
+
+// commit moves the temporary file of a closed writer into the cache, unless writing failed with err.
+func (c *Cache) commit(w *putWriter, err error) error {
+	defer c.notifyEvicted()
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	delete(c.writers, w)
+	if err != nil {
+		return err
+	}
+	if c.closed {
+		return ErrClosed
+	}
+
+	if err := c.checkWriteOnce(w.key); err != nil {
+		return err
+	}
+	name, err := c.filename(w.key)
+	if err != nil {
+		return err
+	}
+	n := w.limit - w.lw.n
+	if n > c.maxEntrySize() { // The cache may have been resized since.
+		return &FileError{c.dir, w.key, ErrTooLarge}
+	}
+	if c.useNames() {
+		if err := appendName(c.dir, name, w.key, c.filePerm()); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(c.dir, name)
+	if err := c.validate(w.key, path, n, w.length); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), c.dirPerm()); err != nil {
+		return &FileError{c.dir, w.key, err}
+	}
+	if err := moveFile(w.f.Name(), path); err != nil {
+		return &FileError{c.dir, w.key, err}
+	}
+	if c.fileMode != 0 {
+		os.Chmod(path, c.fileMode) // Best effort; the blob is in place either way.
+	}
+	m := c.addMeta(w.key, path, n, w.length)
+	m.Checksum = w.h.Sum32()
+	m.Compressed = w.compressed
+	c.countPut(n)
+	return nil
+}